@@ -0,0 +1,550 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The query API is a read-only JSON view of the commits table, served under
+// /api in serve mode and by the api command. It needs the Postgres store.
+//
+// List endpoints return {"data": [...], "next_cursor": "..."}: passing
+// next_cursor back as cursor returns the following page, and it is left out
+// on the last one.
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type api struct {
+	db *sql.DB
+}
+
+// apiHandler returns the handler of the query API for the current store
+func apiHandler() (http.Handler, error) {
+
+	pg, ok := store.(*postgresStore)
+	if !ok {
+		return nil, fmt.Errorf("The query API requires a Postgres database")
+	}
+	return &api{db: pg.db}, nil
+}
+
+// apiCommand serves the query API alone, without ingesting anything. It
+// never migrates the schema, and refuses to start until pending migrations
+// are applied by the ingester or migrate up:
+//
+//	git-sentinel api
+func apiCommand(args []string) error {
+
+	if len(args) != 0 {
+		return fmt.Errorf("usage: git-sentinel api")
+	}
+	opt.AutoMigrate = false
+	if err := dbConnect(); err != nil {
+		return err
+	}
+	handler, err := apiHandler()
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", handler)
+	server, err := startServer(mux)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, stopping", <-stop)
+	stopServer(server)
+	return store.Close()
+}
+
+// apiError is an error answered with its HTTP status
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// page is the body of list responses
+type page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var segments []string
+	for _, s := range strings.Split(strings.Trim(strings.TrimPrefix(req.URL.EscapedPath(), "/api"), "/"), "/") {
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid path"})
+			return
+		}
+		segments = append(segments, u)
+	}
+
+	body, err := a.route(segments, req.URL.Query())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if e, ok := err.(*apiError); ok {
+			status = e.status
+		} else {
+			log.Printf("API request '%s' failed: %s", req.URL.RequestURI(), err.Error())
+			err = fmt.Errorf("internal error")
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (a *api) route(path []string, params url.Values) (interface{}, error) {
+
+	if len(path) == 1 && path[0] == "openapi.json" {
+		return json.RawMessage(openAPISpec), nil
+	}
+
+	q, err := parseQuery(params)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "repos":
+		return a.repos(q)
+	case len(path) == 3 && path[0] == "repos" && path[2] == "commits":
+		q.repos = []string{path[1]}
+		return a.commits(q)
+	case len(path) == 1 && path[0] == "authors":
+		return a.authors(q)
+	case len(path) == 3 && path[0] == "authors" && path[2] == "commits":
+		q.author = path[1]
+		return a.commits(q)
+	case len(path) == 2 && path[0] == "stats" && path[1] == "activity":
+		return a.activity(q)
+	case len(path) == 2 && path[0] == "stats" && path[1] == "languages":
+		return a.languages(q)
+	case len(path) == 2 && path[0] == "stats" && path[1] == "types":
+		return a.types(q)
+	}
+	return nil, &apiError{http.StatusNotFound, "not found"}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+// query holds the filters and paging parameters common to every endpoint
+type query struct {
+	since, until int64
+	repos        []string
+	author       string
+	limit        int
+	cursor       string
+	interval     string
+}
+
+func parseQuery(params url.Values) (*query, error) {
+
+	q := &query{limit: defaultPageSize, cursor: params.Get("cursor"), interval: params.Get("interval")}
+
+	for _, p := range []struct {
+		name  string
+		value *int64
+	}{{"since", &q.since}, {"until", &q.until}} {
+		if v := params.Get(p.name); v != "" {
+			t, err := parseDate(v)
+			if err != nil {
+				return nil, badRequest("invalid %s '%s', expected RFC 3339 or YYYY-MM-DD", p.name, v)
+			}
+			*p.value = t.Unix()
+		}
+	}
+	for _, r := range params["repo"] {
+		q.repos = append(q.repos, strings.Split(r, ",")...)
+	}
+	q.author = params.Get("author")
+
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, badRequest("invalid limit '%s', expected 1 to %d", v, maxPageSize)
+		}
+		q.limit = n
+	}
+	return q, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// filter builds the WHERE clause of a query over commits aliased c
+type filter struct {
+	conditions []string
+	args       []interface{}
+}
+
+// add appends a condition whose placeholders are written as ? and bound,
+// in order, to values
+func (f *filter) add(condition string, values ...interface{}) {
+
+	for _, v := range values {
+		f.args = append(f.args, v)
+		condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(f.args)), 1)
+	}
+	f.conditions = append(f.conditions, condition)
+}
+
+func (f *filter) where() string {
+
+	if len(f.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+func (q *query) filter() *filter {
+
+	f := &filter{}
+	if q.since > 0 {
+		f.add("c.date >= ?", q.since)
+	}
+	if q.until > 0 {
+		f.add("c.date < ?", q.until)
+	}
+	if len(q.repos) > 0 {
+		f.add("c.repo = ANY(?)", pq.Array(q.repos))
+	}
+	if q.author != "" {
+		f.add("lower(c.author) = lower(?)", q.author)
+	}
+	return f
+}
+
+func encodeCursor(values ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(values, "\x00")))
+}
+
+// decodeCursor returns the n values of a cursor
+func decodeCursor(cursor string, n int) ([]string, error) {
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	values := strings.Split(string(b), "\x00")
+	if err != nil || len(values) != n {
+		return nil, badRequest("invalid cursor")
+	}
+	return values, nil
+}
+
+type apiRepo struct {
+	Name        string    `json:"name"`
+	Commits     int64     `json:"commits"`
+	Authors     int64     `json:"authors"`
+	Additions   int64     `json:"additions"`
+	Deletions   int64     `json:"deletions"`
+	FirstCommit time.Time `json:"first_commit"`
+	LastCommit  time.Time `json:"last_commit"`
+}
+
+func (a *api) repos(q *query) (interface{}, error) {
+
+	f := q.filter()
+	if q.cursor != "" {
+		c, err := decodeCursor(q.cursor, 1)
+		if err != nil {
+			return nil, err
+		}
+		f.add("c.repo > ?", c[0])
+	}
+	f.args = append(f.args, q.limit+1)
+
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT c.repo, count(*), count(DISTINCT lower(c.author)), coalesce(sum(c.additions), 0), coalesce(sum(c.deletions), 0), min(c.date), max(c.date)
+		FROM commits c %s GROUP BY c.repo ORDER BY c.repo LIMIT $%d`, f.where(), len(f.args)), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []apiRepo{}
+	for rows.Next() {
+		var r apiRepo
+		var first, last int64
+		if err := rows.Scan(&r.Name, &r.Commits, &r.Authors, &r.Additions, &r.Deletions, &first, &last); err != nil {
+			return nil, err
+		}
+		r.FirstCommit, r.LastCommit = time.Unix(first, 0).UTC(), time.Unix(last, 0).UTC()
+		list = append(list, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	p := page{Data: list}
+	if len(list) > q.limit {
+		p.Data = list[:q.limit]
+		p.NextCursor = encodeCursor(list[q.limit-1].Name)
+	}
+	return p, nil
+}
+
+type apiCommit struct {
+	Repo        string    `json:"repo"`
+	Hash        string    `json:"hash"`
+	AuthorName  string    `json:"author_name"`
+	AuthorEmail string    `json:"author_email"`
+	AuthorDate  time.Time `json:"author_date"`
+	Date        time.Time `json:"date"`
+	Title       string    `json:"title"`
+	Additions   int64     `json:"additions"`
+	Deletions   int64     `json:"deletions"`
+	IsMerge     bool      `json:"is_merge"`
+	Type        string    `json:"type,omitempty"`
+	Scope       string    `json:"scope,omitempty"`
+	Breaking    bool      `json:"breaking"`
+	Release     string    `json:"release,omitempty"`
+}
+
+// commits lists commits newest first
+func (a *api) commits(q *query) (interface{}, error) {
+
+	f := q.filter()
+	if q.cursor != "" {
+		c, err := decodeCursor(q.cursor, 3)
+		if err != nil {
+			return nil, err
+		}
+		date, err := strconv.ParseInt(c[0], 10, 64)
+		if err != nil {
+			return nil, badRequest("invalid cursor")
+		}
+		f.add("(c.date, c.repo, c.hash) < (?, ?, ?)", date, c[1], c[2])
+	}
+	f.args = append(f.args, q.limit+1)
+
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT c.repo, c.hash, coalesce(c.author_name, ''), coalesce(c.author, ''), coalesce(c.author_date, c.date), c.date, coalesce(c.title, ''),
+		coalesce(c.additions, 0), coalesce(c.deletions, 0), c.is_merge, coalesce(c.cc_type, ''), coalesce(c.cc_scope, ''), coalesce(c.cc_breaking, FALSE), coalesce(c.release, '')
+		FROM commits c %s ORDER BY c.date DESC, c.repo DESC, c.hash DESC LIMIT $%d`, f.where(), len(f.args)), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []apiCommit{}
+	var dates []int64
+	for rows.Next() {
+		var c apiCommit
+		var authorDate, date int64
+		if err := rows.Scan(&c.Repo, &c.Hash, &c.AuthorName, &c.AuthorEmail, &authorDate, &date, &c.Title,
+			&c.Additions, &c.Deletions, &c.IsMerge, &c.Type, &c.Scope, &c.Breaking, &c.Release); err != nil {
+			return nil, err
+		}
+		c.AuthorDate, c.Date = time.Unix(authorDate, 0).UTC(), time.Unix(date, 0).UTC()
+		list = append(list, c)
+		dates = append(dates, date)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	p := page{Data: list}
+	if len(list) > q.limit {
+		last := list[q.limit-1]
+		p.Data = list[:q.limit]
+		p.NextCursor = encodeCursor(strconv.FormatInt(dates[q.limit-1], 10), last.Repo, last.Hash)
+	}
+	return p, nil
+}
+
+type apiAuthor struct {
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Commits     int64     `json:"commits"`
+	Repos       int64     `json:"repos"`
+	Additions   int64     `json:"additions"`
+	Deletions   int64     `json:"deletions"`
+	FirstCommit time.Time `json:"first_commit"`
+	LastCommit  time.Time `json:"last_commit"`
+}
+
+// authors lists commit authors by email, case insensitively
+func (a *api) authors(q *query) (interface{}, error) {
+
+	f := q.filter()
+	if q.cursor != "" {
+		c, err := decodeCursor(q.cursor, 1)
+		if err != nil {
+			return nil, err
+		}
+		f.add("lower(c.author) > ?", c[0])
+	}
+	f.args = append(f.args, q.limit+1)
+
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT coalesce(lower(c.author), ''), coalesce(max(c.author_name), ''), count(*), count(DISTINCT c.repo), coalesce(sum(c.additions), 0), coalesce(sum(c.deletions), 0), min(c.date), max(c.date)
+		FROM commits c %s GROUP BY lower(c.author) ORDER BY lower(c.author) LIMIT $%d`, f.where(), len(f.args)), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []apiAuthor{}
+	for rows.Next() {
+		var r apiAuthor
+		var first, last int64
+		if err := rows.Scan(&r.Email, &r.Name, &r.Commits, &r.Repos, &r.Additions, &r.Deletions, &first, &last); err != nil {
+			return nil, err
+		}
+		r.FirstCommit, r.LastCommit = time.Unix(first, 0).UTC(), time.Unix(last, 0).UTC()
+		list = append(list, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	p := page{Data: list}
+	if len(list) > q.limit {
+		p.Data = list[:q.limit]
+		p.NextCursor = encodeCursor(list[q.limit-1].Email)
+	}
+	return p, nil
+}
+
+type apiActivity struct {
+	Period    time.Time `json:"period"`
+	Commits   int64     `json:"commits"`
+	Authors   int64     `json:"authors"`
+	Additions int64     `json:"additions"`
+	Deletions int64     `json:"deletions"`
+}
+
+// activity aggregates commits per day, week or month
+func (a *api) activity(q *query) (interface{}, error) {
+
+	interval := q.interval
+	switch interval {
+	case "":
+		interval = "week"
+	case "day", "week", "month":
+	default:
+		return nil, badRequest("invalid interval '%s', expected day, week or month", interval)
+	}
+
+	f := q.filter()
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT date_trunc('%s', to_timestamp(c.date) AT TIME ZONE 'UTC') AS period, count(*), count(DISTINCT lower(c.author)), coalesce(sum(c.additions), 0), coalesce(sum(c.deletions), 0)
+		FROM commits c %s GROUP BY period ORDER BY period`, interval, f.where()), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []apiActivity{}
+	for rows.Next() {
+		var r apiActivity
+		if err := rows.Scan(&r.Period, &r.Commits, &r.Authors, &r.Additions, &r.Deletions); err != nil {
+			return nil, err
+		}
+		r.Period = r.Period.UTC()
+		list = append(list, r)
+	}
+	return page{Data: list}, rows.Err()
+}
+
+type apiLanguage struct {
+	Language  string `json:"language"`
+	Commits   int64  `json:"commits"`
+	Files     int64  `json:"files"`
+	Additions int64  `json:"additions"`
+	Deletions int64  `json:"deletions"`
+}
+
+// languages aggregates the language breakdown of the commits
+func (a *api) languages(q *query) (interface{}, error) {
+
+	f := q.filter()
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT l.language, count(*), sum(l.files), sum(l.additions), sum(l.deletions)
+		FROM commits c JOIN commit_languages l ON l.repo = c.repo AND l.hash = c.hash %s
+		GROUP BY l.language ORDER BY sum(l.additions) + sum(l.deletions) DESC, l.language`, f.where()), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []apiLanguage{}
+	for rows.Next() {
+		var r apiLanguage
+		if err := rows.Scan(&r.Language, &r.Commits, &r.Files, &r.Additions, &r.Deletions); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return page{Data: list}, rows.Err()
+}
+
+type apiType struct {
+	Type      string `json:"type"`
+	Commits   int64  `json:"commits"`
+	Breaking  int64  `json:"breaking"`
+	Additions int64  `json:"additions"`
+	Deletions int64  `json:"deletions"`
+}
+
+// types aggregates the commits by their classification
+func (a *api) types(q *query) (interface{}, error) {
+
+	f := q.filter()
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT coalesce(c.cc_type, 'unknown'), count(*), count(*) FILTER (WHERE c.cc_breaking), coalesce(sum(c.additions), 0), coalesce(sum(c.deletions), 0)
+		FROM commits c %s GROUP BY 1 ORDER BY 2 DESC, 1`, f.where()), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []apiType{}
+	for rows.Next() {
+		var r apiType
+		if err := rows.Scan(&r.Type, &r.Commits, &r.Breaking, &r.Additions, &r.Deletions); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return page{Data: list}, rows.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Membership lists the commits a branch or tag gained since the last run.
+// When Reset is set the ref was deleted or rewritten and the commits it
+// previously contained must be forgotten first.
+type Membership struct {
+	Ref     string
+	Reset   bool
+	Commits []string
+}
+
+// tracksMembership reports whether commit membership is recorded for ref
+func tracksMembership(ref string) bool {
+	return strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/")
+}
+
+// branches computes membership changes from the recorded and current ref
+// tips. A ref that moved forward only contributes the commits in new ^old;
+// new and rewritten refs are walked in full, once. In first-parent mode the
+// only tip is the default branch, so no other branch or tag is recorded.
+func (r *Repo) branches() error {
+
+	r.Branches = nil
+
+	refs := make([]string, 0, len(r.Tips))
+	for ref := range r.Tips {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	for _, ref := range refs {
+		tip := r.Tips[ref]
+		if !tracksMembership(ref) || r.Refs[ref] == tip {
+			continue
+		}
+
+		m := Membership{Ref: ref}
+		revs := []string{tip}
+		old, had := r.Refs[ref]
+		switch {
+		case had && r.isAncestor(old, tip):
+			revs = append(revs, "^"+old)
+		case had:
+			m.Reset = true
+		}
+
+		commits, err := r.revList(revs...)
+		if err != nil {
+			return err
+		}
+		m.Commits = commits
+		r.Branches = append(r.Branches, m)
+	}
+
+	for ref := range r.Refs {
+		if _, ok := r.Tips[ref]; !ok && tracksMembership(ref) {
+			r.Branches = append(r.Branches, Membership{Ref: ref, Reset: true})
+		}
+	}
+	return nil
+}
+
+func (r *Repo) isAncestor(ancestor, descendant string) bool {
+
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", ancestor, descendant)
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	return cmd.Run() == nil
+}
+
+func (r *Repo) revList(revs ...string) ([]string, error) {
+
+	args := []string{"rev-list"}
+	if r.FirstParent {
+		args = append(args, "--first-parent")
+	}
+	cmd := exec.Command("git", append(args, revs...)...)
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (r *Repo) saveBranches(tx *sql.Tx) error {
+
+	rows := &rowSet{table: "commit_branches", columns: []string{"repo", "ref", "hash"}}
+	for _, m := range r.Branches {
+		if m.Reset {
+			if _, err := tx.Exec("DELETE FROM commit_branches WHERE repo = $1 AND ref = $2", r.Name, m.Ref); err != nil {
+				return err
+			}
+		}
+		for _, h := range m.Commits {
+			rows.add(r.Name, m.Ref, h)
+		}
+	}
+	return copyUpsert(tx, rows)
+}
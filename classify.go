@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Classification is the kind of change a commit makes. Conventional is set
+// when the subject follows the Conventional Commits specification; otherwise
+// the fields are a best guess from the wording of the message.
+type Classification struct {
+	Type         string
+	Scope        string
+	Breaking     bool
+	Conventional bool
+}
+
+// defaultCommitTypes are the Conventional Commits types recognised without
+// configuration. Any other "word: text" subject, such as "WIP: ..." or
+// "README: ...", is classified by the heuristics.
+var defaultCommitTypes = []string{"feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert"}
+
+// commitTypes are the recognised types, set from commit_types in
+// sentinel.yaml
+var commitTypes = mergeCommitTypes(nil)
+
+// maxScope is the length of commits.cc_scope
+const maxScope = 128
+
+var (
+	conventionalSubject = regexp.MustCompile(`^([A-Za-z]+)(?:\(([^()]*)\))?(!)?: \S`)
+	commitTypePattern   = regexp.MustCompile(`^[A-Za-z]{1,32}$`)
+	breakingFooter      = regexp.MustCompile(`(?m)^BREAKING[ -]CHANGE: `)
+	mentionsBreaking    = regexp.MustCompile(`(?i)\bbreaking\b`)
+)
+
+// heuristics maps leading words of a free-form subject to a Conventional
+// Commits type. The first matching rule wins.
+var heuristics = []struct {
+	Type    string
+	Pattern *regexp.Regexp
+}{
+	{"revert", regexp.MustCompile(`(?i)^revert\b`)},
+	{"merge", regexp.MustCompile(`(?i)^merged?\b`)},
+	{"fix", regexp.MustCompile(`(?i)\b(fix(e[sd])?|bug|hotfix|patch(ed)?|resolve[sd]?|correct(s|ed)?)\b`)},
+	{"docs", regexp.MustCompile(`(?i)\b(docs?|documentation|readme|comments?)\b`)},
+	{"test", regexp.MustCompile(`(?i)\b(tests?|testing|specs?)\b`)},
+	{"perf", regexp.MustCompile(`(?i)\b(perf|performance|optimi[sz]e[sd]?|speed up|faster)\b`)},
+	{"refactor", regexp.MustCompile(`(?i)\b(refactor(s|ed|ing)?|clean ?up|restructure[sd]?|rename[sd]?|simplif(y|ies|ied))\b`)},
+	{"ci", regexp.MustCompile(`(?i)\b(ci|pipelines?|workflows?)\b`)},
+	{"build", regexp.MustCompile(`(?i)\b(build|dockerfile|makefile|helm|deps|dependenc(y|ies)|bump(s|ed)?|upgrade[sd]?)\b`)},
+	{"style", regexp.MustCompile(`(?i)\b(style|format(ting)?|lint(ing)?|whitespace)\b`)},
+	{"chore", regexp.MustCompile(`(?i)\b(chore|release|version|wip)\b`)},
+	{"feat", regexp.MustCompile(`(?i)^(add(s|ed)?|implement(s|ed)?|introduce[sd]?|support(s|ed)?|create[sd]?|new|enable[sd]?|allow(s|ed)?)\b`)},
+}
+
+// mergeCommitTypes adds the configured types to the default ones
+func mergeCommitTypes(configured []string) map[string]bool {
+
+	types := map[string]bool{}
+	for _, t := range append(defaultCommitTypes, configured...) {
+		types[strings.ToLower(t)] = true
+	}
+	return types
+}
+
+// checkCommitTypes validates the commit_types of sentinel.yaml, which are
+// stored in commits.cc_type
+func checkCommitTypes(configured []string) error {
+
+	for _, t := range configured {
+		if !commitTypePattern.MatchString(t) {
+			return fmt.Errorf("invalid commit type '%s', expected up to 32 letters", t)
+		}
+	}
+	return nil
+}
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// classify categorises a commit from its subject and body
+func classify(subject, body string) Classification {
+
+	if m := conventionalSubject.FindStringSubmatch(subject); m != nil && commitTypes[strings.ToLower(m[1])] {
+		return Classification{
+			Type:         strings.ToLower(m[1]),
+			Scope:        truncate(m[2], maxScope),
+			Breaking:     m[3] == "!" || breakingFooter.MatchString(body),
+			Conventional: true,
+		}
+	}
+
+	c := Classification{
+		Type:     "other",
+		Breaking: breakingFooter.MatchString(body) || mentionsBreaking.MatchString(subject),
+	}
+	for _, h := range heuristics {
+		if h.Pattern.MatchString(subject) {
+			c.Type = h.Type
+			break
+		}
+	}
+	return c
+}
+
+// commit_types_monthly summarises the change mix per repository and month
+const commitTypesMonthlyView = `CREATE OR REPLACE VIEW commit_types_monthly AS
+SELECT repo, date_trunc('month', to_timestamp(date)) AS month, cc_type AS type,
+	count(*) AS commits,
+	count(*) FILTER (WHERE cc_breaking) AS breaking,
+	count(*) FILTER (WHERE cc_conventional) AS conventional,
+	sum(additions) AS additions,
+	sum(deletions) AS deletions
+FROM commits
+WHERE cc_type IS NOT NULL
+GROUP BY repo, month, cc_type`
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+
+	defer func(types map[string]bool) { commitTypes = types }(commitTypes)
+	commitTypes = mergeCommitTypes([]string{"Deps"})
+
+	tests := []struct {
+		subject, body string
+		want          Classification
+	}{
+		{"feat(api): add cursors", "", Classification{Type: "feat", Scope: "api", Conventional: true}},
+		{"Fix!: drop the v1 endpoints", "", Classification{Type: "fix", Breaking: true, Conventional: true}},
+		{"refactor: split the parser", "BREAKING CHANGE: Parse is gone", Classification{Type: "refactor", Breaking: true, Conventional: true}},
+		{"deps: bump lib/pq", "", Classification{Type: "deps", Conventional: true}},
+		{"WIP: half done", "", Classification{Type: "chore"}},
+		{"README: mention serve mode", "", Classification{Type: "docs"}},
+		{"Merge branch 'feature'", "", Classification{Type: "merge"}},
+		{"Something else entirely", "", Classification{Type: "other"}},
+		{"feat(" + strings.Repeat("é", 200) + "): long scope", "", Classification{Type: "feat", Scope: strings.Repeat("é", maxScope), Conventional: true}},
+		{strings.Repeat("x", 100) + ": no such type", "", Classification{Type: "other"}},
+	}
+	for _, tt := range tests {
+		if got := classify(tt.subject, tt.body); got != tt.want {
+			t.Errorf("classify(%q) = %+v, want %+v", tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCommitTypes(t *testing.T) {
+
+	if err := checkCommitTypes([]string{"deps", "Security"}); err != nil {
+		t.Errorf("checkCommitTypes rejected valid types: %s", err.Error())
+	}
+	for _, bad := range []string{"", "two words", "i18n", strings.Repeat("a", 33)} {
+		if err := checkCommitTypes([]string{bad}); err == nil {
+			t.Errorf("checkCommitTypes accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mkessas/git-sentinel/gitlog"
+)
+
+// filterTrailers keeps the trailers whose key is listed in
+// SENTINEL_TRAILERS, matched case-insensitively and stored with the
+// configured spelling.
+func filterTrailers(trailers []gitlog.Trailer) []gitlog.Trailer {
+
+	var kept []gitlog.Trailer
+	for _, t := range trailers {
+		for _, k := range opt.Trailers {
+			if strings.EqualFold(t.Key, strings.TrimSpace(k)) {
+				kept = append(kept, gitlog.Trailer{Key: strings.TrimSpace(k), Value: t.Value})
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// commit_credits lists every identity credited for a commit: its author and
+// each distinct Co-authored-by email, with share set to the fraction of the
+// commit each one is given under split credit.
+const commitCreditsView = `CREATE OR REPLACE VIEW commit_credits AS
+WITH coauthors AS (
+	SELECT DISTINCT repo, hash, lower(substring(value FROM '<([^>]+)>')) AS email
+	FROM commit_trailers
+	WHERE lower(key) = 'co-authored-by'
+), credited AS (
+	SELECT repo, hash, lower(author) AS email, 'author' AS role FROM commits
+	UNION
+	SELECT co.repo, co.hash, co.email, 'co-author' AS role
+	FROM coauthors co JOIN commits c ON c.repo = co.repo AND c.hash = co.hash
+	WHERE co.email IS NOT NULL AND co.email <> lower(c.author)
+)
+SELECT cr.repo, cr.hash, cr.email, cr.role, c.date, c.additions, c.deletions,
+	1.0 / count(*) OVER (PARTITION BY cr.repo, cr.hash) AS share
+FROM credited cr JOIN commits c ON c.repo = cr.repo AND c.hash = cr.hash`
+
+// author_totals aggregates commit_credits per repository and email under
+// the three crediting modes: author only, full credit to every co-author,
+// and lines split evenly between author and co-authors.
+const authorTotalsView = `CREATE OR REPLACE VIEW author_totals AS
+SELECT repo, email,
+	count(*) FILTER (WHERE role = 'author') AS commits,
+	count(*) AS commits_credited,
+	coalesce(sum(additions) FILTER (WHERE role = 'author'), 0) AS additions,
+	coalesce(sum(deletions) FILTER (WHERE role = 'author'), 0) AS deletions,
+	sum(additions) AS additions_full,
+	sum(deletions) AS deletions_full,
+	sum(additions * share) AS additions_split,
+	sum(deletions * share) AS deletions_split
+FROM commit_credits
+GROUP BY repo, email`
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+
+	// A Wednesday in a leap year
+	from := time.Date(2024, 2, 28, 23, 58, 30, 0, time.UTC)
+	at := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, at(2024, 2, 28, 23, 59)},
+		{"*/15 * * * *", from, at(2024, 2, 29, 0, 0)},
+		{"5/20 * * * *", from, at(2024, 2, 29, 0, 5)},
+		{"0 0 29 2 *", from, at(2024, 2, 29, 0, 0)},
+		{"0 0 30 * *", from, at(2024, 3, 30, 0, 0)},
+		{"0 12 31 * *", from, at(2024, 3, 31, 12, 0)},
+		{"0 0 1,15 * *", from, at(2024, 3, 1, 0, 0)},
+		{"0 9-17/4 * * 1-5", from, at(2024, 2, 29, 9, 0)},
+		{"0 18-20 * * *", at(2024, 2, 28, 19, 0), at(2024, 2, 28, 20, 0)},
+		// 0 and 7 are both Sunday
+		{"30 9 * * 7", from, at(2024, 3, 3, 9, 30)},
+		{"30 9 * * 0", from, at(2024, 3, 3, 9, 30)},
+		{"0 0 * * 5-7", from, at(2024, 3, 1, 0, 0)},
+		// Restricted day of month and day of week: either matches
+		{"0 0 10 * 1", from, at(2024, 3, 4, 0, 0)},
+		{"0 0 2 * 1", from, at(2024, 3, 2, 0, 0)},
+		// A day field starting with * is unrestricted, so both fields must match
+		{"0 0 */2 * 1", from, at(2024, 3, 11, 0, 0)},
+		{"0 0 */10 * *", from, at(2024, 3, 1, 0, 0)},
+		{"0 0 1 * */3", from, at(2024, 5, 1, 0, 0)},
+		// Month and year rollover
+		{"0 0 1 * *", at(2024, 12, 31, 23, 59), at(2025, 1, 1, 0, 0)},
+		{"0 0 * 6 *", from, at(2024, 6, 1, 0, 0)},
+		{"0 0 29 2 *", at(2024, 3, 1, 0, 0), at(2028, 2, 29, 0, 0)},
+		{"@yearly", from, at(2025, 1, 1, 0, 0)},
+		{"@weekly", from, at(2024, 3, 3, 0, 0)},
+		{"@hourly", from, at(2024, 2, 29, 0, 0)},
+		// Strictly after from
+		{"0 0 * * *", at(2024, 3, 1, 0, 0), at(2024, 3, 2, 0, 0)},
+		// Never within five years
+		{"0 0 30 2 *", from, time.Time{}},
+		{"0 0 31 4 *", from, time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", tt.expr, err.Error())
+			continue
+		}
+		if got := c.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q after %s: got %s, want %s", tt.expr, tt.from.Format(time.RFC3339), got.Format(time.RFC3339), tt.want.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+
+	for _, expr := range []string{
+		"", "* * * *", "* * * * * *", "@often",
+		"60 * * * *", "* 24 * * *", "* * 0 * *", "* * 32 * *", "* * * 0 *", "* * * 13 *", "* * * * 8",
+		"*/0 * * * *", "*/x * * * *", "5-1 * * * *", "a * * * *", "1-x * * * *", "1,,2 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
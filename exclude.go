@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// Paths matching the exclude_paths globs of sentinel.yaml, such as vendored
+// dependencies, lockfiles or generated code, are recorded in commit_files
+// like any other path but flagged as excluded and left out of the line
+// counts of commits and languages. Changing the globs only requires running
+// the reprocess command against the stored data.
+
+// compileExcludes validates the exclusion globs of the repository and
+// prepends the global ones.
+func (r *Repo) compileExcludes(global []string) error {
+
+	r.excludes = append(append([]string{}, global...), r.ExcludePaths...)
+	for _, g := range r.excludes {
+		if _, err := matchGlob(g, "x"); err != nil {
+			return fmt.Errorf("[%s] invalid exclude_paths glob '%s': %s", r.Name, g, err.Error())
+		}
+	}
+	return nil
+}
+
+// excluded reports whether a path matches one of the exclusion globs
+func (r *Repo) excluded(p string) bool {
+
+	for _, g := range r.excludes {
+		if ok, _ := matchGlob(g, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyExclusions flags the excluded files of a commit and recomputes its
+// line counts and language breakdown without them.
+func (r *Repo) applyExclusions(c *Commit) {
+
+	c.Excluded = nil
+	c.Insertions, c.Deletions = 0, 0
+	for _, f := range c.Files {
+		if r.excluded(f.Path) {
+			if c.Excluded == nil {
+				c.Excluded = map[string]bool{}
+			}
+			c.Excluded[f.Path] = true
+			continue
+		}
+		c.Insertions += f.Additions
+		c.Deletions += f.Deletions
+	}
+	c.Languages = languageStats(c)
+}
+
+// matchGlob matches a slash separated path against a glob. A glob without a
+// slash matches the file name at any depth ("*.lock"); otherwise it is
+// anchored at the root of the repository, "**" matches any number of
+// directories ("**/*.pb.go") and a trailing slash matches everything below
+// a directory ("vendor/").
+func matchGlob(glob, p string) (bool, error) {
+
+	if !strings.Contains(strings.TrimSuffix(glob, "/"), "/") && !strings.HasSuffix(glob, "/") {
+		return path.Match(glob, path.Base(p))
+	}
+	if strings.HasSuffix(glob, "/") {
+		glob += "**"
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(glob, "/"), "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(glob, p []string) (bool, error) {
+
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(p); i++ {
+				if ok, err := matchSegments(glob[1:], p[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(p) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(glob[0], p[0]); !ok || err != nil {
+			return false, err
+		}
+		glob, p = glob[1:], p[1:]
+	}
+	return len(p) == 0, nil
+}
+
+// reprocessCommand re-applies the exclusion globs and language rules of
+// sentinel.yaml to the stored per-file data of the given repositories, or
+// of all of them:
+//
+//	git-sentinel reprocess [repo...]
+func reprocessCommand(args []string) error {
+
+	selected := map[string]bool{}
+	for _, a := range args {
+		selected[a] = true
+	}
+
+	for i := range repos {
+		r := &repos[i]
+		if len(selected) > 0 && !selected[r.Name] {
+			continue
+		}
+		log.Printf("[%s] Reprocessing stored commits...", r.Name)
+		n, err := r.reprocess()
+		if err != nil {
+			return fmt.Errorf("[%s] Failed to reprocess commits: %s", r.Name, err.Error())
+		}
+		log.Printf("[%s] Reprocessed %d commits", r.Name, n)
+	}
+	return nil
+}
+
+// reprocess recomputes the excluded flags, line counts and language
+// breakdown of every stored commit of the repository.
+func (r *Repo) reprocess() (int, error) {
+
+	commits, err := store.Files(r.Name)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range commits {
+		r.applyExclusions(c)
+	}
+	return len(commits), store.Restat(r.Name, commits)
+}
@@ -0,0 +1,402 @@
+// Package gitlog parses the output of `git log` produced with the arguments
+// returned by Args. Commit headers are emitted as NUL separated fields, each
+// commit record is introduced by an ASCII record separator (0x1e) and file
+// statistics are read in their -z form. Git cannot escape the record
+// separator, so one written in a message or a path splits its commit into
+// records that fail to parse and are reported as RecordErrors.
+package gitlog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	recordSep = '\x1e'
+	fieldSep  = '\x00'
+)
+
+// fields lists the placeholders emitted for each commit, in order, and how
+// each value is stored on the Commit.
+var fields = []struct {
+	placeholder string
+	set         func(c *Commit, v string) error
+}{
+	{"%H", func(c *Commit, v string) error {
+		if v == "" {
+			return fmt.Errorf("empty commit hash")
+		}
+		c.Hash = v
+		return nil
+	}},
+	{"%aN", func(c *Commit, v string) error { c.AuthorName = v; return nil }},
+	{"%aE", func(c *Commit, v string) error { c.Author = v; return nil }},
+	{"%at", func(c *Commit, v string) (err error) { c.AuthorDate, err = parseTimestamp(v); return }},
+	{"%ai", func(c *Commit, v string) (err error) { c.AuthorOffset, err = parseOffset(v); return }},
+	{"%cN", func(c *Commit, v string) error { c.CommitterName = v; return nil }},
+	{"%cE", func(c *Commit, v string) error { c.CommitterEmail = v; return nil }},
+	{"%ct", func(c *Commit, v string) (err error) { c.Date, err = parseTimestamp(v); return }},
+	{"%ci", func(c *Commit, v string) (err error) { c.CommitterOffset, err = parseOffset(v); return }},
+	{"%s", func(c *Commit, v string) error { c.Title = v; return nil }},
+	{"%b", func(c *Commit, v string) error { c.Body = strings.TrimRight(v, "\n"); return nil }},
+	{"%P", func(c *Commit, v string) error {
+		c.Parents = strings.Fields(v)
+		c.IsMerge = len(c.Parents) > 1
+		return nil
+	}},
+	{"%(trailers:only,unfold)", func(c *Commit, v string) error { c.Trailers = parseTrailers(v); return nil }},
+}
+
+// maxRecord caps the size of a single commit record.
+const maxRecord = 64 * 1024 * 1024
+
+// Commit is a single commit as parsed from the log. Author is the author
+// email and Date the committer timestamp; offsets are in minutes east of UTC.
+// Title and Body are the subject and body of the message as written.
+// Invalid UTF-8 in any text, such as a Latin-1 message without an encoding
+// header, is replaced with U+FFFD.
+type Commit struct {
+	Hash            string
+	Author          string
+	AuthorName      string
+	AuthorDate      int64
+	AuthorOffset    int
+	CommitterName   string
+	CommitterEmail  string
+	Date            int64
+	CommitterOffset int
+	Title           string
+	Body            string
+	Parents         []string
+	IsMerge         bool
+	Trailers        []Trailer
+	Insertions      int
+	Deletions       int
+	Files           []File
+}
+
+// File is a single path touched by a commit, as reported by --numstat.
+// Status is the --raw status letter (A, M, D, R, C, T). For renames and
+// copies OldPath is the source path and Similarity its score in percent.
+type File struct {
+	Path       string
+	OldPath    string
+	Status     string
+	Similarity int
+	Additions  int
+	Deletions  int
+	Binary     bool
+}
+
+// Trailer is a "Key: value" line from the trailer block of a commit message
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+// RecordError reports a commit record that could not be parsed. The record
+// is skipped and the Reader can continue with the next one. Hash is empty
+// when the record does not start with a commit hash.
+type RecordError struct {
+	Record int
+	Hash   string
+	Reason string
+}
+
+func (e *RecordError) Error() string {
+	if e.Hash != "" {
+		return fmt.Sprintf("malformed record %d (%s): %s", e.Record, e.Hash, e.Reason)
+	}
+	return fmt.Sprintf("malformed record %d: %s", e.Record, e.Reason)
+}
+
+// Args returns the git log arguments required to produce output that Reader
+// understands. Revision and range arguments are left to the caller.
+func Args() []string {
+
+	format := "--pretty=format:%x1e"
+	for _, f := range fields {
+		format += f.placeholder + "%x00"
+	}
+	return []string{"-z", "--raw", "--numstat", "-M", "-C", format}
+}
+
+// Reader reads commits from a git log stream
+type Reader struct {
+	scanner *bufio.Scanner
+	record  int
+}
+
+// NewReader returns a Reader consuming the log output from r
+func NewReader(r io.Reader) *Reader {
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecord)
+	scanner.Split(splitRecords)
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next commit in the stream. It returns io.EOF once the
+// stream is exhausted and a *RecordError for a record that is malformed, in
+// which case the caller may keep calling Next.
+func (r *Reader) Next() (*Commit, error) {
+
+	for r.scanner.Scan() {
+		data := r.scanner.Bytes()
+		if len(bytes.Trim(data, "\x00\n")) == 0 {
+			continue
+		}
+		r.record++
+		return parseRecord(r.record, data)
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// splitRecords is a bufio.SplitFunc yielding the data between two record
+// separators.
+func splitRecords(data []byte, atEOF bool) (int, []byte, error) {
+
+	start := 0
+	if len(data) > 0 && data[0] == recordSep {
+		start = 1
+	}
+	if i := bytes.IndexByte(data[start:], recordSep); i >= 0 {
+		return start + i, data[start : start+i], nil
+	}
+	if atEOF && len(data) > start {
+		return len(data), data[start:], nil
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
+
+func parseRecord(n int, data []byte) (*Commit, error) {
+
+	header := make([]string, 0, len(fields))
+	rest := data
+	for range fields {
+		i := bytes.IndexByte(rest, fieldSep)
+		if i < 0 {
+			return nil, &RecordError{Record: n, Hash: hashField(header), Reason: fmt.Sprintf("expected %d header fields, found %d", len(fields), len(header))}
+		}
+		header = append(header, text(rest[:i]))
+		rest = rest[i+1:]
+	}
+
+	c := &Commit{}
+	for i, f := range fields {
+		if err := f.set(c, header[i]); err != nil {
+			return nil, &RecordError{Record: n, Hash: hashField(header), Reason: err.Error()}
+		}
+	}
+
+	files, err := parseChanges(bytes.Split(bytes.Trim(rest, "\x00\n"), []byte{fieldSep}))
+	if err != nil {
+		return nil, &RecordError{Record: n, Hash: c.Hash, Reason: err.Error()}
+	}
+	for _, f := range files {
+		c.Insertions += f.Additions
+		c.Deletions += f.Deletions
+	}
+	c.Files = files
+	return c, nil
+}
+
+func parseTimestamp(v string) (int64, error) {
+
+	t, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", v)
+	}
+	return t, nil
+}
+
+// parseOffset extracts the UTC offset, in minutes, from an ISO-like date
+// such as "2019-05-19 20:45:02 +1200".
+func parseOffset(v string) (int, error) {
+
+	tz := v[strings.LastIndexByte(v, ' ')+1:]
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') {
+		return 0, fmt.Errorf("invalid date %q", v)
+	}
+	h, err1 := strconv.Atoi(tz[1:3])
+	m, err2 := strconv.Atoi(tz[3:5])
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid date %q", v)
+	}
+	offset := h*60 + m
+	if tz[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
+
+// parseTrailers parses "Key: value" lines. Lines whose key is not a git
+// trailer token, made of letters, digits and hyphens, are skipped.
+func parseTrailers(v string) []Trailer {
+
+	var trailers []Trailer
+	for _, line := range strings.Split(v, "\n") {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if !isToken(key) {
+			continue
+		}
+		trailers = append(trailers, Trailer{
+			Key:   key,
+			Value: strings.TrimSpace(line[i+1:]),
+		})
+	}
+	return trailers
+}
+
+func isToken(s string) bool {
+
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseChanges parses the NUL separated --raw entries of a commit followed
+// by its --numstat entries, and pairs them up. A raw entry is
+// ":<modes> <objects> <status>" followed by one path, or two for renames and
+// copies. A numstat entry is "<added>\t<deleted>\t<path>", or
+// "<added>\t<deleted>\t" followed by the source and destination paths.
+func parseChanges(tokens [][]byte) ([]File, error) {
+
+	var raw, stats []File
+	for i := 0; i < len(tokens); i++ {
+		tok := bytes.TrimLeft(tokens[i], "\n")
+		if len(tok) == 0 {
+			continue
+		}
+
+		if tok[0] == ':' {
+			meta := bytes.Fields(tok)
+			if len(meta) < 5 {
+				return nil, fmt.Errorf("invalid raw entry %q", tok)
+			}
+			f, paths, err := parseStatus(string(meta[len(meta)-1]))
+			if err != nil {
+				return nil, err
+			}
+			if i+paths >= len(tokens) {
+				return nil, fmt.Errorf("truncated raw entry %q", tok)
+			}
+			f.Path = text(tokens[i+paths])
+			if paths == 2 {
+				f.OldPath = text(tokens[i+1])
+			}
+			i += paths
+			raw = append(raw, f)
+			continue
+		}
+
+		f, err := parseNumstat(tok)
+		if err != nil {
+			return nil, err
+		}
+		if f.Path == "" {
+			if i+2 >= len(tokens) {
+				return nil, fmt.Errorf("truncated numstat entry %q", tok)
+			}
+			f.OldPath, f.Path = text(tokens[i+1]), text(tokens[i+2])
+			i += 2
+		}
+		stats = append(stats, f)
+	}
+
+	if len(raw) != len(stats) {
+		return nil, fmt.Errorf("%d raw entries but %d numstat entries", len(raw), len(stats))
+	}
+	for i := range stats {
+		if raw[i].Path != stats[i].Path || raw[i].OldPath != stats[i].OldPath {
+			return nil, fmt.Errorf("raw entry %q does not match numstat entry %q", raw[i].Path, stats[i].Path)
+		}
+		stats[i].Status = raw[i].Status
+		stats[i].Similarity = raw[i].Similarity
+	}
+	return stats, nil
+}
+
+// parseStatus parses a raw status such as "M" or "R095" and returns the
+// number of paths that follow it.
+func parseStatus(status string) (File, int, error) {
+
+	f := File{Status: status[:1]}
+	switch f.Status {
+	case "R", "C":
+		score, err := strconv.Atoi(status[1:])
+		if err != nil {
+			return File{}, 0, fmt.Errorf("invalid raw status %q", status)
+		}
+		f.Similarity = score
+		return f, 2, nil
+	case "A", "M", "D", "T", "U", "X":
+		return f, 1, nil
+	}
+	return File{}, 0, fmt.Errorf("invalid raw status %q", status)
+}
+
+// parseNumstat parses a single numstat entry. Binary files are reported by
+// git with "-" in place of both counters. The path is empty for renames
+// and copies, whose paths follow as separate entries.
+func parseNumstat(entry []byte) (File, error) {
+
+	parts := bytes.SplitN(entry, []byte{'\t'}, 3)
+	if len(parts) != 3 {
+		return File{}, fmt.Errorf("invalid numstat entry %q", entry)
+	}
+
+	f := File{Path: text(parts[2])}
+	if string(parts[0]) == "-" && string(parts[1]) == "-" {
+		f.Binary = true
+		return f, nil
+	}
+
+	var err error
+	if f.Additions, err = strconv.Atoi(string(parts[0])); err != nil {
+		return File{}, fmt.Errorf("invalid numstat entry %q", entry)
+	}
+	if f.Deletions, err = strconv.Atoi(string(parts[1])); err != nil {
+		return File{}, fmt.Errorf("invalid numstat entry %q", entry)
+	}
+	return f, nil
+}
+
+// text converts a value to a string that is valid UTF-8, as git emits
+// messages and paths as they were written
+func text(b []byte) string {
+	return strings.ToValidUTF8(string(b), "\uFFFD")
+}
+
+// hashField returns the commit hash of a header, if its first field is
+// one: the part of a record split by a stray separator starts elsewhere
+func hashField(header []string) string {
+
+	if len(header) == 0 || (len(header[0]) != 40 && len(header[0]) != 64) {
+		return ""
+	}
+	if strings.Trim(header[0], "0123456789abcdef") != "" {
+		return ""
+	}
+	return header[0]
+}
@@ -0,0 +1,159 @@
+package gitlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// entry is a single result of Next, as recorded in the golden files
+type entry struct {
+	Commit *Commit `json:",omitempty"`
+	Error  string  `json:",omitempty"`
+}
+
+// readAll returns every result of Next until io.EOF or an error the Reader
+// cannot continue after. It fails if the stream never ends.
+func readAll(t *testing.T, data []byte) []entry {
+
+	var entries []entry
+	r := NewReader(bytes.NewReader(data))
+	for i := 0; i <= len(data)+1; i++ {
+		c, err := r.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			entries = append(entries, entry{Error: err.Error()})
+			if _, ok := err.(*RecordError); !ok {
+				return entries
+			}
+			continue
+		}
+		entries = append(entries, entry{Commit: c})
+	}
+	t.Fatalf("Next did not return io.EOF after %d calls", len(data)+2)
+	return nil
+}
+
+// TestGolden parses the logs captured by testdata/capture.sh and compares
+// the commits with the matching .golden file
+func TestGolden(t *testing.T) {
+
+	logs, err := filepath.Glob("testdata/*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 {
+		t.Fatal("no logs in testdata")
+	}
+
+	for _, name := range logs {
+		t.Run(strings.TrimSuffix(filepath.Base(name), ".log"), func(t *testing.T) {
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(readAll(t, data), "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(name, ".log") + ".golden"
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("parsed %s differs from %s:\n%s", name, golden, got)
+			}
+		})
+	}
+}
+
+// TestCaptureArgs checks that the fixtures are captured with Args
+func TestCaptureArgs(t *testing.T) {
+
+	script, err := ioutil.ReadFile("testdata/capture.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`(?m)^LOG_ARGS='(.*)'$`).FindSubmatch(script)
+	if m == nil {
+		t.Fatal("LOG_ARGS not found in capture.sh")
+	}
+	if want := strings.Join(Args(), " "); string(m[1]) != want {
+		t.Errorf("capture.sh uses %s, Args returns %s", m[1], want)
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+
+	tests := []struct {
+		date   string
+		offset int
+		err    bool
+	}{
+		{"2019-05-19 20:45:02 +1200", 720, false},
+		{"2019-05-19 20:45:02 -0530", -330, false},
+		{"2019-05-19 20:45:02 +0000", 0, false},
+		{"2019-05-19 20:45:02", 0, true},
+		{"", 0, true},
+		{"+12a0", 0, true},
+	}
+	for _, tt := range tests {
+		offset, err := parseOffset(tt.date)
+		if (err != nil) != tt.err || offset != tt.offset {
+			t.Errorf("parseOffset(%q) = %d, %v, want %d, error %v", tt.date, offset, err, tt.offset, tt.err)
+		}
+	}
+}
+
+func TestParseTrailers(t *testing.T) {
+
+	got := parseTrailers("Co-authored-by: Jane <jane@example.com>\nSigned-off-by:me\nNot a key: value\n" +
+		strings.Repeat("x", 300) + " y: z\n: empty\nno separator\nRefs: AB#1: AB#2")
+	want := []Trailer{
+		{Key: "Co-authored-by", Value: "Jane <jane@example.com>"},
+		{Key: "Signed-off-by", Value: "me"},
+		{Key: "Refs", Value: "AB#1: AB#2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTrailers = %v, want %v", got, want)
+	}
+}
+
+// FuzzReader checks that no input makes the Reader panic or loop
+func FuzzReader(f *testing.F) {
+
+	logs, _ := filepath.Glob("testdata/*.log")
+	for _, name := range logs {
+		if data, err := ioutil.ReadFile(name); err == nil {
+			f.Add(data)
+		}
+	}
+	f.Add([]byte{})
+	f.Add([]byte("\x1e"))
+	f.Add([]byte("\x1e\x1e\x00\x00"))
+	f.Add([]byte("\x1eh\x00a\x00e\x001\x00x +0000\x00c\x00e\x001\x00x +0000\x00s\x00\x00\x00\x00\n:0 0 0 0 R\x00a\x00-\t-\t\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readAll(t, data)
+	})
+}
@@ -0,0 +1,94 @@
+#!/bin/sh
+# Rebuilds the fixture repository and captures the *.log files used by the
+# golden tests. Regenerate the *.golden files afterwards:
+#
+#	cd gitlog/testdata && ./capture.sh
+#	cd .. && go test -run TestGolden -update
+#
+# LOG_ARGS must match gitlog.Args(), which TestCaptureArgs checks.
+set -e
+
+LOG_ARGS='-z --raw --numstat -M -C --pretty=format:%x1e%H%x00%aN%x00%aE%x00%at%x00%ai%x00%cN%x00%cE%x00%ct%x00%ci%x00%s%x00%b%x00%P%x00%(trailers:only,unfold)%x00'
+
+here=$(pwd)
+repo=$(mktemp -d)
+trap 'rm -rf "$repo"' EXIT
+cd "$repo"
+
+export GIT_AUTHOR_NAME='Jane Doe' GIT_AUTHOR_EMAIL='jane@example.com'
+export GIT_COMMITTER_NAME='John Roe' GIT_COMMITTER_EMAIL='john@example.com'
+tick=1546300800
+commit() {
+	tick=$((tick + 3600))
+	GIT_AUTHOR_DATE="@$tick +1200" GIT_COMMITTER_DATE="@$((tick + 60)) -0500" git commit -q "$@"
+}
+capture() {
+	name=$1
+	shift
+	git log $LOG_ARGS "$@" >"$here/$name.log"
+}
+
+git init -q -b master .
+git config core.autocrlf false
+
+seq 1 40 >numbers.txt
+printf 'hello\n' >hello.txt
+git add . && commit -m 'Initial commit'
+
+git mv numbers.txt digits.txt
+commit -m 'Rename numbers to digits'
+capture rename -1
+
+cp digits.txt copy.txt
+echo 41 >>digits.txt
+git add . && commit -m 'Copy digits'
+capture copy -1
+
+rm hello.txt && ln -s digits.txt hello.txt
+git add . && commit -m 'Turn hello into a symlink'
+capture typechange -1
+
+printf '\000\001\002\003binary' >blob.bin
+git add . && commit -m 'Add a binary file'
+capture binary -1
+
+printf 'tab\n' >"$(printf 'with\ttab.txt')"
+git add . && commit -m 'Add a path with a tab'
+capture tab -1
+
+commit --allow-empty -m 'Nothing changed'
+capture empty -1
+
+printf 'trailers\n' >trailers.txt
+git add . && commit -m 'Add trailers' -m 'Some body text.' -m "$(printf 'Signed-off-by: Jane Doe <jane@example.com>\nCo-authored-by: Ann Other\n  <ann@example.com>\nReviewed-by: John Roe <john@example.com>')"
+capture trailers -1
+
+git checkout -q -b feature
+printf 'one\n' >feature.txt
+git add . && commit -m 'Feature one'
+printf 'two\n' >>feature.txt
+git add . && commit -m 'Feature two'
+git checkout -q master
+printf 'main\n' >main.txt
+git add . && commit -m 'Work on master'
+tick=$((tick + 3600))
+GIT_AUTHOR_DATE="@$tick +1200" GIT_COMMITTER_DATE="@$((tick + 60)) -0500" git merge -q --no-ff -m 'Merge branch feature' feature
+capture merge -3 --first-parent -m
+
+printf 'stray\n' >stray.txt
+git add . && commit -m "$(printf 'Subject with a stray \036 separator')"
+capture stray -1
+
+printf 'latin1\n' >"$(printf 'caf\351.txt')"
+git add .
+# git commit would re-encode the message, so write the object directly
+tick=$((tick + 3600))
+latin1=$(printf 'tree %s\nparent %s\nauthor %s <%s> %d +1200\ncommitter %s <%s> %d -0500\n\nCaf\351 without an encoding header\n' \
+	"$(git write-tree)" "$(git rev-parse HEAD)" "$GIT_AUTHOR_NAME" "$GIT_AUTHOR_EMAIL" $tick "$GIT_COMMITTER_NAME" "$GIT_COMMITTER_EMAIL" $((tick + 60)) |
+	git hash-object -t commit -w --stdin)
+git reset -q --soft "$latin1"
+capture latin1 -1
+
+capture history
+head -c $(($(wc -c <"$here/history.log") / 2)) "$here/history.log" >"$here/truncated.log"
+rm "$here/history.log"
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// PathChange is a change made to a file by a commit, as stored in
+// commit_files
+type PathChange struct {
+	Hash       string
+	Author     string
+	Date       int64
+	Path       string
+	OldPath    string
+	Status     string
+	Similarity int
+	Additions  int
+	Deletions  int
+}
+
+// maxRenames bounds how many renames pathHistory follows
+const maxRenames = 1000
+
+// pathHistory returns the changes made to a file, newest first, following
+// it back across the renames recorded in commit_files: once the commit that
+// renamed the file to its current path is reached, the history continues
+// with the previous path, up to the date of that rename. Commits sharing
+// the date of a rename are listed again by the next query, so a change
+// already listed is skipped, which also stops a file renamed back and
+// forth from being followed in circles.
+func pathHistory(repo, file string) ([]PathChange, error) {
+
+	var history []PathChange
+	bound := int64(math.MaxInt64)
+	seen := map[[2]string]bool{}
+
+	for i := 0; i < maxRenames && file != ""; i++ {
+		changes, err := store.PathChanges(repo, file, bound)
+		if err != nil {
+			return nil, err
+		}
+
+		next := ""
+		for _, p := range changes {
+			if seen[[2]string{p.Path, p.Hash}] {
+				continue
+			}
+			seen[[2]string{p.Path, p.Hash}] = true
+			history = append(history, p)
+			if p.Status == "R" {
+				next, bound = p.OldPath, p.Date
+				break
+			}
+		}
+		file = next
+	}
+	return history, nil
+}
+
+// historyCommand prints the history of a file of a repository:
+//
+//	git-sentinel history <repo> <path>
+func historyCommand(args []string) error {
+
+	if len(args) != 2 {
+		return fmt.Errorf("usage: git-sentinel history <repo> <path>")
+	}
+
+	history, err := pathHistory(args[0], args[1])
+	if err != nil {
+		return fmt.Errorf("Failed to query path history: %s", err.Error())
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tCOMMIT\tAUTHOR\tSTATUS\tPATH\t+\t-")
+	for _, p := range history {
+		file := p.Path
+		if p.OldPath != "" {
+			file = fmt.Sprintf("%s => %s (%d%%)", p.OldPath, p.Path, p.Similarity)
+		}
+		fmt.Fprintf(w, "%s\t%.12s\t%s\t%s\t%s\t%d\t%d\n",
+			time.Unix(p.Date, 0).UTC().Format("2006-01-02"), p.Hash, p.Author, p.Status, file, p.Additions, p.Deletions)
+	}
+	return w.Flush()
+}
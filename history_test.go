@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mkessas/git-sentinel/gitlog"
+)
+
+func TestPathHistory(t *testing.T) {
+
+	defer func(s Store) { store = s }(store)
+	store = newMemoryStore()
+
+	// a.go is renamed to b.go and back by two commits of the same date
+	r := &Repo{Name: "history", Commits: []Commit{
+		testCommit("history", 1, 100, gitlog.File{Path: "a.go", Status: "A", Additions: 10}),
+		testCommit("history", 2, 200, gitlog.File{Path: "b.go", OldPath: "a.go", Status: "R", Similarity: 100}),
+		testCommit("history", 3, 200, gitlog.File{Path: "a.go", OldPath: "b.go", Status: "R", Similarity: 100}),
+		testCommit("history", 4, 300, gitlog.File{Path: "a.go", Status: "M", Additions: 1, Deletions: 1}),
+		testCommit("history", 5, 400, gitlog.File{Path: "b.go", Status: "A", Additions: 3}),
+	}}
+	if err := store.Save(r); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := pathHistory("history", "a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, p := range history {
+		hashes = append(hashes, p.Hash)
+	}
+	if want := []string{testHash(4), testHash(3), testHash(2), testHash(1)}; !reflect.DeepEqual(hashes, want) {
+		t.Errorf("history of a.go: got %v, want %v", hashes, want)
+	}
+}
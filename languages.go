@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Languages maps changed paths to a language. Filenames are matched against
+// the base name of a path, then its extension against Extensions, then the
+// part of the base name before its first dot against Filenames again (so
+// that Dockerfile.prod is a Dockerfile). Entries in sentinel.yaml are merged
+// over the defaults below.
+type Languages struct {
+	Extensions map[string]string `yaml:"extensions"`
+	Filenames  map[string]string `yaml:"filenames"`
+}
+
+// LanguageStat is the lines a commit added and deleted in one language
+type LanguageStat struct {
+	Language  string
+	Files     int
+	Additions int
+	Deletions int
+}
+
+// otherLanguage is reported for paths no rule matches
+const otherLanguage = "Other"
+
+var defaultLanguages = Languages{
+	Extensions: map[string]string{
+		".go": "Go", ".java": "Java", ".kt": "Kotlin", ".kts": "Kotlin", ".scala": "Scala",
+		".groovy": "Groovy", ".gradle": "Groovy", ".ts": "TypeScript", ".tsx": "TypeScript",
+		".js": "JavaScript", ".jsx": "JavaScript", ".mjs": "JavaScript", ".cjs": "JavaScript",
+		".vue": "Vue", ".py": "Python", ".rb": "Ruby", ".php": "PHP", ".cs": "C#", ".fs": "F#",
+		".vb": "Visual Basic", ".c": "C", ".h": "C", ".cc": "C++", ".cpp": "C++", ".cxx": "C++",
+		".hpp": "C++", ".hh": "C++", ".m": "Objective-C", ".swift": "Swift", ".rs": "Rust",
+		".dart": "Dart", ".lua": "Lua", ".pl": "Perl", ".r": "R", ".ex": "Elixir", ".exs": "Elixir",
+		".erl": "Erlang", ".hs": "Haskell", ".clj": "Clojure", ".sh": "Shell", ".bash": "Shell",
+		".zsh": "Shell", ".ps1": "PowerShell", ".sql": "SQL", ".yaml": "YAML", ".yml": "YAML",
+		".json": "JSON", ".xml": "XML", ".html": "HTML", ".htm": "HTML", ".css": "CSS",
+		".scss": "SCSS", ".sass": "SCSS", ".less": "Less", ".md": "Markdown",
+		".rst": "reStructuredText", ".tf": "Terraform", ".tfvars": "Terraform",
+		".proto": "Protocol Buffers", ".toml": "TOML", ".ini": "INI", ".properties": "Properties",
+		".graphql": "GraphQL", ".gql": "GraphQL", ".txt": "Text", ".csv": "CSV",
+	},
+	Filenames: map[string]string{
+		"Dockerfile": "Dockerfile", "Makefile": "Makefile", "Jenkinsfile": "Groovy",
+		"CMakeLists.txt": "CMake", "Gemfile": "Ruby", "Rakefile": "Ruby", "Vagrantfile": "Ruby",
+		"go.mod": "Go", "go.sum": "Go",
+	},
+}
+
+// languages holds the rules in effect once sentinel.yaml is loaded
+var languages = defaultLanguages
+
+// mergeLanguages returns the default rules overridden by the configured ones
+func mergeLanguages(configured Languages) Languages {
+
+	merged := Languages{Extensions: map[string]string{}, Filenames: map[string]string{}}
+	for _, l := range []Languages{defaultLanguages, configured} {
+		for k, v := range l.Extensions {
+			merged.Extensions[strings.ToLower(k)] = v
+		}
+		for k, v := range l.Filenames {
+			merged.Filenames[k] = v
+		}
+	}
+	return merged
+}
+
+// language returns the language of a path
+func (l Languages) language(p string) string {
+
+	base := path.Base(p)
+	if lang, ok := l.Filenames[base]; ok {
+		return lang
+	}
+	if lang, ok := l.Extensions[strings.ToLower(path.Ext(base))]; ok {
+		return lang
+	}
+	if i := strings.IndexByte(base, '.'); i > 0 {
+		if lang, ok := l.Filenames[base[:i]]; ok {
+			return lang
+		}
+	}
+	return otherLanguage
+}
+
+// languageStats breaks the lines changed by a commit down by language,
+// leaving out excluded paths
+func languageStats(c *Commit) []LanguageStat {
+
+	byLanguage := map[string]*LanguageStat{}
+	for _, f := range c.Files {
+		if c.Excluded[f.Path] {
+			continue
+		}
+		lang := languages.language(f.Path)
+		s, ok := byLanguage[lang]
+		if !ok {
+			s = &LanguageStat{Language: lang}
+			byLanguage[lang] = s
+		}
+		s.Files++
+		s.Additions += f.Additions
+		s.Deletions += f.Deletions
+	}
+
+	stats := make([]LanguageStat, 0, len(byLanguage))
+	for _, s := range byLanguage {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Language < stats[j].Language })
+	return stats
+}
+
+// language_totals aggregates the language breakdown per repository and
+// author; sum over either to get per-repository or per-author totals.
+const languageTotalsView = `CREATE OR REPLACE VIEW language_totals AS
+SELECT l.repo, lower(c.author) AS author, l.language,
+	count(*) AS commits,
+	sum(l.additions) AS additions,
+	sum(l.deletions) AS deletions
+FROM commit_languages l JOIN commits c ON c.repo = l.repo AND c.hash = l.hash
+GROUP BY l.repo, lower(c.author), l.language`
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryStore keeps ingested data in the process only, for dry runs and
+// tests: memory:// ingests every repository from scratch and forgets it
+// on exit.
+type memoryStore struct {
+	mu    sync.Mutex
+	repos map[string]*memoryRepo
+}
+
+type memoryRepo struct {
+	commits  map[string]*Commit
+	releases map[string]string
+	branches map[string]map[string]bool
+	tags     map[string]Tag
+	refs     map[string]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{repos: map[string]*memoryRepo{}}
+}
+
+// repo returns the data of a repository, creating it on first use. The
+// caller holds mu.
+func (s *memoryStore) repo(name string) *memoryRepo {
+
+	m, ok := s.repos[name]
+	if !ok {
+		m = &memoryRepo{
+			commits:  map[string]*Commit{},
+			releases: map[string]string{},
+			branches: map[string]map[string]bool{},
+			tags:     map[string]Tag{},
+			refs:     map[string]string{},
+		}
+		s.repos[name] = m
+	}
+	return m
+}
+
+func (s *memoryStore) Load(r *Repo) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.repo(r.Name)
+
+	r.knownTags = map[string]storedTag{}
+	for name, t := range m.tags {
+		r.knownTags[name] = storedTag{Object: t.Object, Release: t.Release}
+	}
+	r.Refs = map[string]string{}
+	for ref, h := range m.refs {
+		r.Refs[ref] = h
+	}
+
+	r.LastUpdated = 0
+	if len(r.Refs) == 0 {
+		for _, c := range m.commits {
+			if c.Date > r.LastUpdated {
+				r.LastUpdated = c.Date
+			}
+		}
+	}
+	return nil
+}
+
+// Save applies everything under the lock, so readers see either none or all
+// of a run.
+func (s *memoryStore) Save(r *Repo) error {
+
+	for _, step := range []string{"commits", "branches", "releases", "tags", "refs"} {
+		if err := saveStep(step); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.repo(r.Name)
+
+	r.Ingested = 0
+	for i := range r.Commits {
+		if _, ok := m.commits[r.Commits[i].Hash]; !ok {
+			c := r.Commits[i]
+			m.commits[c.Hash] = &c
+			r.Ingested++
+		}
+	}
+
+	for _, b := range r.Branches {
+		if b.Reset || m.branches[b.Ref] == nil {
+			m.branches[b.Ref] = map[string]bool{}
+		}
+		for _, h := range b.Commits {
+			m.branches[b.Ref][h] = true
+		}
+	}
+
+	for _, t := range r.Tags {
+		m.tags[t.Name] = t
+	}
+	for _, name := range r.DeletedTags {
+		delete(m.tags, name)
+	}
+	if r.ResetReleases {
+		m.releases = map[string]string{}
+	}
+	for _, rel := range r.Releases {
+		for _, h := range rel.Commits {
+			if _, ok := m.commits[h]; !ok {
+				continue
+			}
+			// Same takeover rule as the Postgres store
+			cur, ok := m.releases[h]
+			if !ok || m.tags[cur].Date > m.tags[rel.Tag].Date {
+				m.releases[h] = rel.Tag
+			}
+		}
+	}
+
+	if r.Tips != nil {
+		m.refs = map[string]string{}
+		for ref, h := range r.Tips {
+			m.refs[ref] = h
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Files(repo string) ([]*Commit, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.repo(repo)
+
+	var commits []*Commit
+	for _, c := range m.commits {
+		if len(c.Files) == 0 {
+			continue
+		}
+		cp := &Commit{Repo: repo}
+		cp.Hash = c.Hash
+		cp.Files = append(cp.Files, c.Files...)
+		commits = append(commits, cp)
+	}
+	sort.Slice(commits, func(i, j int) bool { return commits[i].Hash < commits[j].Hash })
+	return commits, nil
+}
+
+func (s *memoryStore) Restat(repo string, commits []*Commit) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.repo(repo)
+
+	for _, c := range commits {
+		if stored, ok := m.commits[c.Hash]; ok {
+			stored.Excluded = c.Excluded
+			stored.Insertions, stored.Deletions = c.Insertions, c.Deletions
+			stored.Languages = c.Languages
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) PathChanges(repo, path string, before int64) ([]PathChange, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.repo(repo)
+
+	var changes []PathChange
+	for _, c := range m.commits {
+		if c.Date > before {
+			continue
+		}
+		for _, f := range c.Files {
+			if f.Path == path {
+				changes = append(changes, PathChange{Hash: c.Hash, Author: c.Author, Date: c.Date, Path: f.Path, OldPath: f.OldPath,
+					Status: f.Status, Similarity: f.Similarity, Additions: f.Additions, Deletions: f.Deletions})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Date != changes[j].Date {
+			return changes[i].Date > changes[j].Date
+		}
+		return changes[i].Hash < changes[j].Hash
+	})
+	return changes, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
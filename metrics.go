@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ingestion metrics are kept in the Prometheus text format: served on
+// /metrics in serve mode and, when SENTINEL_METRICS_FILE is set, written to
+// that file for the textfile collector of the node exporter after every
+// run. In CronJob mode the previous file is read back on startup, so
+// counters, consecutive failures and the last success of repositories
+// that fail keep their values across runs.
+
+type family struct {
+	name, kind, help string
+	values           map[string]float64
+}
+
+type registry struct {
+	sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+var metrics = newRegistry([]*family{
+	{name: "sentinel_stage_duration_seconds", kind: "gauge", help: "Duration of the last run of each stage (sync, load, parse, save) per repository."},
+	{name: "sentinel_commits_ingested_total", kind: "counter", help: "Commits stored per repository, excluding those already stored."},
+	{name: "sentinel_runs_total", kind: "counter", help: "Runs per repository and result (success or failure)."},
+	{name: "sentinel_last_success_timestamp_seconds", kind: "gauge", help: "Time of the last successful run per repository."},
+	{name: "sentinel_consecutive_failures", kind: "gauge", help: "Runs that failed in a row per repository."},
+	{name: "sentinel_git_exits_total", kind: "counter", help: "Exit codes of git commands per repository and command, -1 when git was killed."},
+	{name: "sentinel_skipped_commits_total", kind: "counter", help: "Malformed log records skipped per repository and commit hash, empty when unknown."},
+	{name: "sentinel_db_errors_total", kind: "counter", help: "Database errors per repository and operation (load or save)."},
+})
+
+func newRegistry(families []*family) *registry {
+
+	r := &registry{families: families, byName: map[string]*family{}}
+	for _, f := range families {
+		f.values = map[string]float64{}
+		r.byName[f.name] = f
+	}
+	return r
+}
+
+// labels renders name/value pairs as a label set
+func labels(pairs ...string) string {
+
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], v)
+	}
+	return b.String()
+}
+
+func (r *registry) set(name string, value float64, pairs ...string) {
+
+	r.Lock()
+	defer r.Unlock()
+	r.byName[name].values[labels(pairs...)] = value
+}
+
+func (r *registry) add(name string, delta float64, pairs ...string) {
+
+	r.Lock()
+	defer r.Unlock()
+	r.byName[name].values[labels(pairs...)] += delta
+}
+
+// write writes every metric in the text exposition format
+func (r *registry) write(w io.Writer) error {
+
+	r.Lock()
+	defer r.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range r.families {
+		if len(f.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(bw, "%s{%s} %s\n", f.name, k, strconv.FormatFloat(f.values[k], 'f', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+// load reads back the metrics of a file written by writeFile. A missing
+// file is not an error.
+func (r *registry) load(path string) error {
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r.Lock()
+	defer r.Unlock()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		open, end := strings.Index(line, "{"), strings.LastIndex(line, "} ")
+		if strings.HasPrefix(line, "#") || open < 0 || end < open {
+			continue
+		}
+		f, ok := r.byName[line[:open]]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[end+2:], 64)
+		if err != nil {
+			continue
+		}
+		f.values[line[open+1:end]] = v
+	}
+	return scanner.Err()
+}
+
+// writeFile replaces path atomically, as the textfile collector may read
+// it at any time
+func (r *registry) writeFile(path string) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := r.write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadMetricsFile restores the metrics of the previous run, if any
+func loadMetricsFile() {
+
+	if opt.MetricsFile == "" {
+		return
+	}
+	if err := metrics.load(opt.MetricsFile); err != nil {
+		log.Printf("Failed to read metrics file '%s': %s", opt.MetricsFile, err.Error())
+	}
+}
+
+// writeMetricsFile writes the metrics to SENTINEL_METRICS_FILE, if set
+func writeMetricsFile() {
+
+	if opt.MetricsFile == "" {
+		return
+	}
+	if err := metrics.writeFile(opt.MetricsFile); err != nil {
+		log.Printf("Failed to write metrics file '%s': %s", opt.MetricsFile, err.Error())
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+}
+
+// observeStage records how long a stage of a repository took
+func observeStage(repo, stage string, start time.Time) {
+	metrics.set("sentinel_stage_duration_seconds", time.Since(start).Seconds(), "repo", repo, "stage", stage)
+}
+
+// observeGit records the exit code of a git command
+func observeGit(repo, command string, err error) {
+
+	code := 0
+	if err != nil {
+		code = -1
+		if ee, ok := err.(*exec.ExitError); ok {
+			code = ee.ExitCode()
+		}
+	}
+	metrics.add("sentinel_git_exits_total", 1, "repo", repo, "command", command, "code", strconv.Itoa(code))
+}
+
+// observeSkipped records a malformed log record skipped by a run
+func observeSkipped(repo, hash string) {
+	metrics.add("sentinel_skipped_commits_total", 1, "repo", repo, "hash", hash)
+}
+
+// observeRun records the outcome of processing a repository
+func observeRun(repo string, commits int, err error) {
+
+	if err != nil {
+		metrics.add("sentinel_runs_total", 1, "repo", repo, "result", "failure")
+		metrics.add("sentinel_consecutive_failures", 1, "repo", repo)
+		return
+	}
+	metrics.add("sentinel_runs_total", 1, "repo", repo, "result", "success")
+	metrics.add("sentinel_commits_ingested_total", float64(commits), "repo", repo)
+	metrics.set("sentinel_consecutive_failures", 0, "repo", repo)
+	metrics.set("sentinel_last_success_timestamp_seconds", float64(time.Now().Unix()), "repo", repo)
+}
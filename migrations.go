@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The schema is versioned by an ordered list of migrations compiled into
+// the binary. Applied versions are recorded in schema_migrations; each
+// migration runs in its own transaction together with its record.
+//
+// Migrations are written so that they also apply cleanly to databases
+// created before versioning was introduced, whatever state the
+// CREATE TABLE IF NOT EXISTS statements of the time left them in.
+
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// statements returns a migration step executing SQL statements in order
+func statements(s ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		return execAll(tx, s...)
+	}
+}
+
+var migrations = []migration{
+	{1, "initial", statements(
+		"CREATE TABLE IF NOT EXISTS commits (hash VARCHAR(12) NOT NULL PRIMARY KEY, repo VARCHAR(128), author VARCHAR(256), date BIGINT, title VARCHAR(256), ref VARCHAR(256),additions BIGINT, deletions BIGINT)",
+		"CREATE INDEX IF NOT EXISTS date ON commits (date)",
+		"CREATE INDEX IF NOT EXISTS author ON commits (author)",
+		"CREATE INDEX IF NOT EXISTS repo ON commits (repo)",
+	)},
+	{2, "full_hashes", upgradeCommits},
+	{3, "commit_files", func(tx *sql.Tx) error {
+		err := execAll(tx, "CREATE TABLE IF NOT EXISTS commit_files (hash VARCHAR(40) NOT NULL, repo VARCHAR(128) NOT NULL, path TEXT NOT NULL, additions BIGINT, deletions BIGINT, binary BOOLEAN NOT NULL DEFAULT FALSE, PRIMARY KEY (repo, hash, path), FOREIGN KEY (repo, hash) REFERENCES commits(repo, hash) ON DELETE CASCADE ON UPDATE CASCADE)")
+		if err != nil {
+			return err
+		}
+		if err := upgradeCommitFiles(tx); err != nil {
+			return err
+		}
+		return execAll(tx,
+			"ALTER TABLE commit_files ADD COLUMN IF NOT EXISTS old_path TEXT",
+			"ALTER TABLE commit_files ADD COLUMN IF NOT EXISTS status VARCHAR(1)",
+			"ALTER TABLE commit_files ADD COLUMN IF NOT EXISTS similarity SMALLINT",
+			"ALTER TABLE commit_files ADD COLUMN IF NOT EXISTS excluded BOOLEAN NOT NULL DEFAULT FALSE",
+			"CREATE INDEX IF NOT EXISTS commit_files_path ON commit_files (repo, path)",
+		)
+	}},
+	{4, "commit_metadata", statements(
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS is_merge BOOLEAN NOT NULL DEFAULT FALSE",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS author_name VARCHAR(256)",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS author_email VARCHAR(256)",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS author_date BIGINT",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS author_tz INTEGER",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS committer_name VARCHAR(256)",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS committer_email VARCHAR(256)",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS committer_date BIGINT",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS committer_tz INTEGER",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS body TEXT",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS cc_type VARCHAR(32)",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS cc_scope VARCHAR(128)",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS cc_breaking BOOLEAN",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS cc_conventional BOOLEAN",
+		"ALTER TABLE commits ADD COLUMN IF NOT EXISTS release VARCHAR(256)",
+		"ALTER TABLE commits ALTER COLUMN title TYPE TEXT",
+		"CREATE INDEX IF NOT EXISTS commits_release ON commits (repo, release)",
+	)},
+	{5, "commit_relations", statements(
+		"CREATE TABLE IF NOT EXISTS commit_parents (hash VARCHAR(40) NOT NULL, repo VARCHAR(128) NOT NULL, parent VARCHAR(40) NOT NULL, position INTEGER NOT NULL, PRIMARY KEY (repo, hash, position), FOREIGN KEY (repo, hash) REFERENCES commits(repo, hash) ON DELETE CASCADE ON UPDATE CASCADE)",
+		"CREATE INDEX IF NOT EXISTS commit_parents_parent ON commit_parents (repo, parent)",
+		"CREATE TABLE IF NOT EXISTS commit_trailers (hash VARCHAR(40) NOT NULL, repo VARCHAR(128) NOT NULL, position INTEGER NOT NULL, key VARCHAR(128) NOT NULL, value TEXT NOT NULL, PRIMARY KEY (repo, hash, position), FOREIGN KEY (repo, hash) REFERENCES commits(repo, hash) ON DELETE CASCADE ON UPDATE CASCADE)",
+		"CREATE TABLE IF NOT EXISTS commit_work_items (hash VARCHAR(40) NOT NULL, repo VARCHAR(128) NOT NULL, item VARCHAR(128) NOT NULL, PRIMARY KEY (repo, hash, item), FOREIGN KEY (repo, hash) REFERENCES commits(repo, hash) ON DELETE CASCADE ON UPDATE CASCADE)",
+		"CREATE INDEX IF NOT EXISTS commit_work_items_item ON commit_work_items (item)",
+		"CREATE TABLE IF NOT EXISTS commit_languages (hash VARCHAR(40) NOT NULL, repo VARCHAR(128) NOT NULL, language VARCHAR(64) NOT NULL, files INTEGER NOT NULL, additions BIGINT NOT NULL, deletions BIGINT NOT NULL, PRIMARY KEY (repo, hash, language), FOREIGN KEY (repo, hash) REFERENCES commits(repo, hash) ON DELETE CASCADE ON UPDATE CASCADE)",
+		"CREATE TABLE IF NOT EXISTS commit_branches (repo VARCHAR(128) NOT NULL, ref TEXT NOT NULL, hash VARCHAR(40) NOT NULL, PRIMARY KEY (repo, ref, hash))",
+		"CREATE INDEX IF NOT EXISTS commit_branches_hash ON commit_branches (repo, hash)",
+		"CREATE TABLE IF NOT EXISTS repo_refs (repo VARCHAR(128) NOT NULL, ref TEXT NOT NULL, hash VARCHAR(40) NOT NULL, PRIMARY KEY (repo, ref))",
+		"CREATE TABLE IF NOT EXISTS tags (repo VARCHAR(128) NOT NULL, name VARCHAR(256) NOT NULL, object VARCHAR(40) NOT NULL, target VARCHAR(40) NOT NULL, annotated BOOLEAN NOT NULL, tagger_name VARCHAR(256), tagger_email VARCHAR(256), date BIGINT, message TEXT, signed BOOLEAN NOT NULL DEFAULT FALSE, signature_status VARCHAR(16), is_release BOOLEAN NOT NULL DEFAULT TRUE, PRIMARY KEY (repo, name))",
+	)},
+	{6, "views", statements(views...)},
+	{7, "text_identities", retype(
+		"ALTER TABLE commits ALTER COLUMN author TYPE TEXT",
+		"ALTER TABLE commits ALTER COLUMN author_name TYPE TEXT",
+		"ALTER TABLE commits ALTER COLUMN author_email TYPE TEXT",
+		"ALTER TABLE commits ALTER COLUMN committer_name TYPE TEXT",
+		"ALTER TABLE commits ALTER COLUMN committer_email TYPE TEXT",
+	)},
+	{8, "text_tags", retype(
+		"ALTER TABLE commits ALTER COLUMN release TYPE TEXT",
+		"ALTER TABLE tags ALTER COLUMN name TYPE TEXT",
+		"ALTER TABLE tags ALTER COLUMN tagger_name TYPE TEXT",
+		"ALTER TABLE tags ALTER COLUMN tagger_email TYPE TEXT",
+	)},
+	{9, "text_work_items", retype(
+		"ALTER TABLE commit_work_items ALTER COLUMN item TYPE TEXT",
+	)},
+	{10, "text_trailer_keys", retype(
+		"ALTER TABLE commit_trailers ALTER COLUMN key TYPE TEXT",
+	)},
+}
+
+// views are the reporting views, in the order they are created
+var views = []string{
+	commitCreditsView,
+	authorTotalsView,
+	commitTypesMonthlyView,
+	workItemRollupView,
+	releaseStatsView,
+	languageTotalsView,
+}
+
+// retype returns a migration step changing the type of columns. Postgres
+// refuses to change columns a view selects, so the views are dropped first
+// and created again afterwards.
+func retype(s ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		if err := execAll(tx, "DROP VIEW IF EXISTS author_totals, commit_credits, commit_types_monthly, work_item_rollup, release_stats, language_totals"); err != nil {
+			return err
+		}
+		if err := execAll(tx, s...); err != nil {
+			return err
+		}
+		return execAll(tx, views...)
+	}
+}
+
+// migrationLock is the advisory lock serialising concurrent migrations
+const migrationLock = 0x53454e54
+
+// appliedMigrations returns the versions recorded in schema_migrations,
+// none when the table does not exist yet
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return map[int]time.Time{}, err
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+// unknownMigrations returns the applied versions this binary does not know,
+// i.e. those of a newer release.
+func unknownMigrations(applied map[int]time.Time) []int {
+
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+	var unknown []int
+	for v := range applied {
+		if !known[v] {
+			unknown = append(unknown, v)
+		}
+	}
+	return unknown
+}
+
+// checkSchema refuses to run against a schema this binary does not know
+// and brings an older one up to date, unless SENTINEL_AUTO_MIGRATE is
+// disabled.
+func checkSchema(db *sql.DB) error {
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return fmt.Errorf("Failed to read schema version: %s", err.Error())
+	}
+	if unknown := unknownMigrations(applied); len(unknown) > 0 {
+		return fmt.Errorf("Database schema has migrations %v unknown to this version (latest known is %d), refusing to run", unknown, migrations[len(migrations)-1].Version)
+	}
+
+	pending := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return nil
+	}
+	if !opt.AutoMigrate {
+		return fmt.Errorf("Database schema has %d pending migrations, run 'git-sentinel migrate up'", pending)
+	}
+	return migrateUp(db)
+}
+
+// migrateUp applies every pending migration in order
+func migrateUp(db *sql.DB) error {
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY, name VARCHAR(128) NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())"); err != nil {
+		return fmt.Errorf("Failed to create schema_migrations: %s", err.Error())
+	}
+	for _, m := range migrations {
+		if err := m.apply(db); err != nil {
+			return fmt.Errorf("Failed to apply migration %d (%s): %s", m.Version, m.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+func (m migration) apply(db *sql.DB) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1::bigint)", migrationLock); err != nil {
+		return err
+	}
+	var done bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", m.Version).Scan(&done); err != nil || done {
+		return err
+	}
+
+	log.Printf("Applying schema migration %d (%s)...", m.Version, m.Name)
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations(version, name) VALUES($1,$2)", m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateCommand manages the schema of a Postgres store:
+//
+//	git-sentinel migrate up
+//	git-sentinel migrate status
+func migrateCommand(args []string) error {
+
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		return fmt.Errorf("usage: git-sentinel migrate up|status")
+	}
+	if !strings.HasPrefix(opt.DbURL, "postgres") {
+		return fmt.Errorf("Schema migrations only apply to Postgres databases")
+	}
+
+	db, err := sql.Open("postgres", opt.DbURL)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to database '%s': %s", opt.DbURL, err.Error())
+	}
+	defer db.Close()
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return fmt.Errorf("Failed to read schema version: %s", err.Error())
+	}
+	unknown := unknownMigrations(applied)
+
+	if args[0] == "up" {
+		if len(unknown) > 0 {
+			return fmt.Errorf("Database schema has migrations %v unknown to this version, refusing to migrate", unknown)
+		}
+		if err := migrateUp(db); err != nil {
+			return err
+		}
+		log.Printf("Database schema is at version %d", migrations[len(migrations)-1].Version)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		status := "pending"
+		if at, ok := applied[m.Version]; ok {
+			status = at.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, status)
+	}
+	for _, v := range unknown {
+		fmt.Fprintf(w, "%d\t(unknown)\t%s\n", v, applied[v].Format(time.RFC3339))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+
+	mongo "github.com/9spokes/go/db"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/mkessas/git-sentinel/gitlog"
+)
+
+// MongoDB has no transactions across documents, so a run is written in an
+// order that makes it safe to repeat: commits and branch membership are
+// inserted idempotently first, releases next, and the tags and ref
+// watermarks last, as a stored tag is not assigned again. A run failing
+// part way through leaves the tags and watermarks where they were and the
+// next one stores whatever is missing.
+
+// mongoBatch bounds the number of operations sent in one bulk request and
+// of hashes in one $in
+const mongoBatch = 1000
+
+// mongoStore keeps each commit as one document of the commits collection,
+// with its files, parents, trailers, work items, languages and release
+// embedded.
+type mongoStore struct {
+	m mongo.MongoDB
+}
+
+type mongoCommit struct {
+	Repo           string           `bson:"repo"`
+	Hash           string           `bson:"hash"`
+	Author         string           `bson:"author"`
+	AuthorName     string           `bson:"author_name"`
+	AuthorDate     int64            `bson:"author_date"`
+	AuthorTZ       int              `bson:"author_tz"`
+	CommitterName  string           `bson:"committer_name"`
+	CommitterEmail string           `bson:"committer_email"`
+	Date           int64            `bson:"date"`
+	CommitterTZ    int              `bson:"committer_tz"`
+	Title          string           `bson:"title"`
+	Body           string           `bson:"body"`
+	Additions      int              `bson:"additions"`
+	Deletions      int              `bson:"deletions"`
+	IsMerge        bool             `bson:"is_merge"`
+	Parents        []string         `bson:"parents"`
+	Trailers       []gitlog.Trailer `bson:"trailers"`
+	WorkItems      []string         `bson:"work_items"`
+	Languages      []LanguageStat   `bson:"languages"`
+	Files          []mongoFile      `bson:"files"`
+	CCType         string           `bson:"cc_type"`
+	CCScope        string           `bson:"cc_scope"`
+	CCBreaking     bool             `bson:"cc_breaking"`
+	CCConventional bool             `bson:"cc_conventional"`
+	Release        string           `bson:"release,omitempty"`
+}
+
+type mongoFile struct {
+	Path       string `bson:"path"`
+	OldPath    string `bson:"old_path,omitempty"`
+	Status     string `bson:"status"`
+	Similarity int    `bson:"similarity"`
+	Additions  int    `bson:"additions"`
+	Deletions  int    `bson:"deletions"`
+	Binary     bool   `bson:"binary"`
+	Excluded   bool   `bson:"excluded"`
+}
+
+type mongoTag struct {
+	Repo            string `bson:"repo"`
+	Name            string `bson:"name"`
+	Object          string `bson:"object"`
+	Target          string `bson:"target"`
+	Annotated       bool   `bson:"annotated"`
+	TaggerName      string `bson:"tagger_name,omitempty"`
+	TaggerEmail     string `bson:"tagger_email,omitempty"`
+	Date            int64  `bson:"date"`
+	Message         string `bson:"message,omitempty"`
+	Signed          bool   `bson:"signed"`
+	SignatureStatus string `bson:"signature_status"`
+	Release         bool   `bson:"is_release"`
+}
+
+type mongoRef struct {
+	Ref  string `bson:"ref"`
+	Hash string `bson:"hash"`
+}
+
+func openMongo(dbURL string) (*mongoStore, error) {
+
+	m, err := mongo.Connect(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to database: %s", err.Error())
+	}
+	s := &mongoStore{m: m}
+
+	database := m.Session.DB("")
+	indexes := map[string][]mgo.Index{
+		"commits": {
+			{Key: []string{"repo", "hash"}, Unique: true},
+			{Key: []string{"repo", "-date"}},
+			{Key: []string{"repo", "files.path"}},
+		},
+		"commit_branches": {{Key: []string{"repo", "ref", "hash"}, Unique: true}},
+		"tags":            {{Key: []string{"repo", "name"}, Unique: true}},
+	}
+	for name, list := range indexes {
+		for _, index := range list {
+			if err := database.C(name).EnsureIndex(index); err != nil {
+				m.Session.Close()
+				return nil, fmt.Errorf("Failed to create indexes on '%s': %s", name, err.Error())
+			}
+		}
+	}
+	return s, nil
+}
+
+func toMongo(c *Commit) mongoCommit {
+
+	doc := mongoCommit{
+		Repo: c.Repo, Hash: c.Hash, Author: c.Author, AuthorName: c.AuthorName, AuthorDate: c.AuthorDate, AuthorTZ: c.AuthorOffset,
+		CommitterName: c.CommitterName, CommitterEmail: c.CommitterEmail, Date: c.Date, CommitterTZ: c.CommitterOffset,
+		Title: c.Title, Body: c.Body, Additions: c.Insertions, Deletions: c.Deletions, IsMerge: c.IsMerge,
+		Parents: c.Parents, Trailers: c.Trailers, WorkItems: c.WorkItems, Languages: c.Languages,
+		CCType: c.Class.Type, CCScope: c.Class.Scope, CCBreaking: c.Class.Breaking, CCConventional: c.Class.Conventional,
+	}
+	doc.Files = mongoFiles(c)
+	return doc
+}
+
+func mongoFiles(c *Commit) []mongoFile {
+
+	files := make([]mongoFile, 0, len(c.Files))
+	for _, f := range c.Files {
+		files = append(files, mongoFile{Path: f.Path, OldPath: f.OldPath, Status: f.Status, Similarity: f.Similarity,
+			Additions: f.Additions, Deletions: f.Deletions, Binary: f.Binary, Excluded: c.Excluded[f.Path]})
+	}
+	return files
+}
+
+// insertAll inserts documents in batches, ignoring those already present
+func insertAll(c *mgo.Collection, docs []interface{}) error {
+
+	for start := 0; start < len(docs); start += mongoBatch {
+		end := start + mongoBatch
+		if end > len(docs) {
+			end = len(docs)
+		}
+		bulk := c.Bulk()
+		bulk.Unordered()
+		bulk.Insert(docs[start:end]...)
+		if _, err := bulk.Run(); err != nil && !mgo.IsDup(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// batches splits a list of hashes for use in $in queries
+func batches(hashes []string) [][]string {
+
+	var out [][]string
+	for len(hashes) > mongoBatch {
+		out = append(out, hashes[:mongoBatch])
+		hashes = hashes[mongoBatch:]
+	}
+	if len(hashes) > 0 {
+		out = append(out, hashes)
+	}
+	return out
+}
+
+func (s *mongoStore) Load(r *Repo) error {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+	database := session.DB("")
+
+	var tags []mongoTag
+	if err := database.C("tags").Find(bson.M{"repo": r.Name}).All(&tags); err != nil {
+		return fmt.Errorf("Failed to load tags: %s", err.Error())
+	}
+	r.knownTags = map[string]storedTag{}
+	for _, t := range tags {
+		r.knownTags[t.Name] = storedTag{Object: t.Object, Release: t.Release}
+	}
+
+	var refs struct {
+		Refs []mongoRef `bson:"refs"`
+	}
+	err := database.C("repo_refs").FindId(r.Name).One(&refs)
+	if err != nil && err != mgo.ErrNotFound {
+		return fmt.Errorf("Failed to load ref watermarks: %s", err.Error())
+	}
+	r.Refs = map[string]string{}
+	for _, ref := range refs.Refs {
+		r.Refs[ref.Ref] = ref.Hash
+	}
+	if len(r.Refs) > 0 {
+		return nil
+	}
+
+	var latest struct {
+		Date int64 `bson:"date"`
+	}
+	err = database.C("commits").Find(bson.M{"repo": r.Name}).Sort("-date").Select(bson.M{"date": 1}).One(&latest)
+	switch {
+	case err == mgo.ErrNotFound:
+		r.LastUpdated = 0
+	case err != nil:
+		return fmt.Errorf("Failed to execute query: %s", err.Error())
+	default:
+		r.LastUpdated = latest.Date
+	}
+	return nil
+}
+
+func (s *mongoStore) Save(r *Repo) error {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+	database := session.DB("")
+
+	r.Ingested = 0
+	if err := saveStep("commits"); err != nil {
+		return err
+	}
+	// Bulk inserts do not report how many documents were duplicates, so
+	// those already stored are counted first
+	commits := database.C("commits")
+	hashes := make([]string, 0, len(r.Commits))
+	docs := make([]interface{}, 0, len(r.Commits))
+	for i := range r.Commits {
+		hashes = append(hashes, r.Commits[i].Hash)
+		docs = append(docs, toMongo(&r.Commits[i]))
+	}
+	stored := 0
+	for _, list := range batches(hashes) {
+		n, err := commits.Find(bson.M{"repo": r.Name, "hash": bson.M{"$in": list}}).Count()
+		if err != nil {
+			return fmt.Errorf("error saving commits: %s", err.Error())
+		}
+		stored += n
+	}
+	if err := insertAll(commits, docs); err != nil {
+		return fmt.Errorf("error saving commits: %s", err.Error())
+	}
+	r.Ingested = len(docs) - stored
+
+	if err := saveStep("branches"); err != nil {
+		return err
+	}
+	branches := database.C("commit_branches")
+	for _, m := range r.Branches {
+		if m.Reset {
+			if _, err := branches.RemoveAll(bson.M{"repo": r.Name, "ref": m.Ref}); err != nil {
+				return fmt.Errorf("error saving commit_branches: %s", err.Error())
+			}
+		}
+		docs := make([]interface{}, 0, len(m.Commits))
+		for _, h := range m.Commits {
+			docs = append(docs, bson.M{"repo": r.Name, "ref": m.Ref, "hash": h})
+		}
+		if err := insertAll(branches, docs); err != nil {
+			return fmt.Errorf("error saving commit_branches: %s", err.Error())
+		}
+	}
+
+	if err := saveStep("releases"); err != nil {
+		return err
+	}
+	if err := s.saveReleases(database, r); err != nil {
+		return fmt.Errorf("error saving releases: %s", err.Error())
+	}
+
+	if err := saveStep("tags"); err != nil {
+		return err
+	}
+	if err := s.saveTags(database, r); err != nil {
+		return fmt.Errorf("error saving tags: %s", err.Error())
+	}
+
+	if err := saveStep("refs"); err != nil {
+		return err
+	}
+	if r.Tips == nil {
+		return nil
+	}
+	refs := make([]mongoRef, 0, len(r.Tips))
+	for ref, h := range r.Tips {
+		refs = append(refs, mongoRef{Ref: ref, Hash: h})
+	}
+	if _, err := database.C("repo_refs").UpsertId(r.Name, bson.M{"refs": refs}); err != nil {
+		return fmt.Errorf("error saving repo_refs: %s", err.Error())
+	}
+	return nil
+}
+
+// saveReleases assigns commits to the releases that first contain them,
+// like the Postgres store. The tags of the run are not written yet, so
+// release dates come from the stored tags updated with those of the run.
+func (s *mongoStore) saveReleases(database *mgo.Database, r *Repo) error {
+
+	commits := database.C("commits")
+	if r.ResetReleases {
+		if _, err := commits.UpdateAll(bson.M{"repo": r.Name, "release": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"release": ""}}); err != nil {
+			return err
+		}
+	}
+	if len(r.Releases) == 0 {
+		return nil
+	}
+
+	var stored []mongoTag
+	if err := database.C("tags").Find(bson.M{"repo": r.Name, "is_release": true}).All(&stored); err != nil {
+		return err
+	}
+	dates := map[string]int64{}
+	for _, t := range stored {
+		dates[t.Name] = t.Date
+	}
+	for _, t := range r.Tags {
+		delete(dates, t.Name)
+		if t.Release {
+			dates[t.Name] = t.Date
+		}
+	}
+	for _, name := range r.DeletedTags {
+		delete(dates, name)
+	}
+
+	for _, rel := range r.Releases {
+		// A release tagged after the fact on an older commit takes over
+		// the commits it contains from later releases
+		later := []string{}
+		for name, date := range dates {
+			if date > dates[rel.Tag] {
+				later = append(later, name)
+			}
+		}
+		for _, hashes := range batches(rel.Commits) {
+			_, err := commits.UpdateAll(bson.M{
+				"repo": r.Name,
+				"hash": bson.M{"$in": hashes},
+				"$or":  []bson.M{{"release": bson.M{"$exists": false}}, {"release": bson.M{"$in": later}}},
+			}, bson.M{"$set": bson.M{"release": rel.Tag}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveTags records new and changed tags and forgets deleted ones. It runs
+// after saveReleases: until the tags are written the next run sees them
+// as new and assigns their releases again.
+func (s *mongoStore) saveTags(database *mgo.Database, r *Repo) error {
+
+	tags := database.C("tags")
+	for _, t := range r.Tags {
+		doc := mongoTag{Repo: r.Name, Name: t.Name, Object: t.Object, Target: t.Target, Annotated: t.Annotated, TaggerName: t.TaggerName, TaggerEmail: t.TaggerEmail,
+			Date: t.Date, Message: t.Message, Signed: t.Signed, SignatureStatus: t.SignatureStatus, Release: t.Release}
+		if _, err := tags.Upsert(bson.M{"repo": r.Name, "name": t.Name}, doc); err != nil {
+			return err
+		}
+	}
+	if len(r.DeletedTags) > 0 {
+		if _, err := tags.RemoveAll(bson.M{"repo": r.Name, "name": bson.M{"$in": r.DeletedTags}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) Files(repo string) ([]*Commit, error) {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+
+	var commits []*Commit
+	var doc mongoCommit
+	iter := session.DB("").C("commits").Find(bson.M{"repo": repo, "files.0": bson.M{"$exists": true}}).
+		Select(bson.M{"hash": 1, "files": 1}).Sort("hash").Iter()
+	for iter.Next(&doc) {
+		c := &Commit{Repo: repo, Commit: gitlog.Commit{Hash: doc.Hash}}
+		for _, f := range doc.Files {
+			c.Files = append(c.Files, gitlog.File{Path: f.Path, OldPath: f.OldPath, Status: f.Status, Similarity: f.Similarity,
+				Additions: f.Additions, Deletions: f.Deletions, Binary: f.Binary})
+		}
+		commits = append(commits, c)
+		doc = mongoCommit{}
+	}
+	return commits, iter.Close()
+}
+
+func (s *mongoStore) Restat(repo string, commits []*Commit) error {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+	coll := session.DB("").C("commits")
+
+	for start := 0; start < len(commits); start += mongoBatch {
+		end := start + mongoBatch
+		if end > len(commits) {
+			end = len(commits)
+		}
+		bulk := coll.Bulk()
+		bulk.Unordered()
+		for _, c := range commits[start:end] {
+			bulk.Update(bson.M{"repo": repo, "hash": c.Hash}, bson.M{"$set": bson.M{
+				"files": mongoFiles(c), "additions": c.Insertions, "deletions": c.Deletions, "languages": c.Languages,
+			}})
+		}
+		if _, err := bulk.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) PathChanges(repo, path string, before int64) ([]PathChange, error) {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+
+	var changes []PathChange
+	var doc mongoCommit
+	iter := session.DB("").C("commits").Find(bson.M{"repo": repo, "files.path": path, "date": bson.M{"$lte": before}}).
+		Select(bson.M{"hash": 1, "author": 1, "date": 1, "files": 1}).Sort("-date", "hash").Iter()
+	for iter.Next(&doc) {
+		for _, f := range doc.Files {
+			if f.Path == path {
+				changes = append(changes, PathChange{Hash: doc.Hash, Author: doc.Author, Date: doc.Date, Path: f.Path, OldPath: f.OldPath,
+					Status: f.Status, Similarity: f.Similarity, Additions: f.Additions, Deletions: f.Deletions})
+			}
+		}
+		doc = mongoCommit{}
+	}
+	return changes, iter.Close()
+}
+
+func (s *mongoStore) Close() error {
+
+	s.m.Session.Close()
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+// openAPISpec describes the query API, served on /api/openapi.json
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Git Sentinel query API",
+    "description": "Read-only access to the commits ingested by Git Sentinel. Lists are paginated: pass the next_cursor of a response as cursor to get the following page.",
+    "version": "1"
+  },
+  "servers": [{"url": "/api"}],
+  "paths": {
+    "/repos": {
+      "get": {
+        "summary": "Repositories with their commit totals",
+        "parameters": [
+          {"$ref": "#/components/parameters/since"},
+          {"$ref": "#/components/parameters/until"},
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/author"},
+          {"$ref": "#/components/parameters/limit"},
+          {"$ref": "#/components/parameters/cursor"}
+        ],
+        "responses": {
+          "200": {"description": "A page of repositories", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RepoPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/repos/{name}/commits": {
+      "get": {
+        "summary": "Commits of a repository, newest first",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/since"},
+          {"$ref": "#/components/parameters/until"},
+          {"$ref": "#/components/parameters/author"},
+          {"$ref": "#/components/parameters/limit"},
+          {"$ref": "#/components/parameters/cursor"}
+        ],
+        "responses": {
+          "200": {"description": "A page of commits", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CommitPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/authors": {
+      "get": {
+        "summary": "Commit authors, by email, with their totals",
+        "parameters": [
+          {"$ref": "#/components/parameters/since"},
+          {"$ref": "#/components/parameters/until"},
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/author"},
+          {"$ref": "#/components/parameters/limit"},
+          {"$ref": "#/components/parameters/cursor"}
+        ],
+        "responses": {
+          "200": {"description": "A page of authors", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuthorPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/authors/{email}/commits": {
+      "get": {
+        "summary": "Commits of an author, newest first",
+        "parameters": [
+          {"name": "email", "in": "path", "required": true, "description": "Matched case insensitively", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/since"},
+          {"$ref": "#/components/parameters/until"},
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/limit"},
+          {"$ref": "#/components/parameters/cursor"}
+        ],
+        "responses": {
+          "200": {"description": "A page of commits", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CommitPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/stats/activity": {
+      "get": {
+        "summary": "Commits, authors and lines per period",
+        "parameters": [
+          {"name": "interval", "in": "query", "schema": {"type": "string", "enum": ["day", "week", "month"], "default": "week"}},
+          {"$ref": "#/components/parameters/since"},
+          {"$ref": "#/components/parameters/until"},
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/author"}
+        ],
+        "responses": {
+          "200": {"description": "One entry per period with commits, oldest first", "content": {"application/json": {"schema": {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Activity"}}}}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/stats/languages": {
+      "get": {
+        "summary": "Files and lines changed per language",
+        "parameters": [
+          {"$ref": "#/components/parameters/since"},
+          {"$ref": "#/components/parameters/until"},
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/author"}
+        ],
+        "responses": {
+          "200": {"description": "One entry per language, most changed first", "content": {"application/json": {"schema": {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Language"}}}}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/stats/types": {
+      "get": {
+        "summary": "Commits per type (feat, fix, docs, ...)",
+        "parameters": [
+          {"$ref": "#/components/parameters/since"},
+          {"$ref": "#/components/parameters/until"},
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/author"}
+        ],
+        "responses": {
+          "200": {"description": "One entry per commit type, most frequent first", "content": {"application/json": {"schema": {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Type"}}}}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "since": {"name": "since", "in": "query", "description": "Only commits committed at or after this date (RFC 3339 or YYYY-MM-DD)", "schema": {"type": "string"}},
+      "until": {"name": "until", "in": "query", "description": "Only commits committed before this date (RFC 3339 or YYYY-MM-DD)", "schema": {"type": "string"}},
+      "repo": {"name": "repo", "in": "query", "description": "Only these repositories, repeated or comma separated", "schema": {"type": "array", "items": {"type": "string"}}, "style": "form", "explode": true},
+      "author": {"name": "author", "in": "query", "description": "Only commits by this author email, case insensitively", "schema": {"type": "string"}},
+      "limit": {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}},
+      "cursor": {"name": "cursor", "in": "query", "description": "The next_cursor of the previous page", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "BadRequest": {"description": "Invalid parameters", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {"type": "object", "properties": {"error": {"type": "string"}}},
+      "Repo": {"type": "object", "properties": {
+        "name": {"type": "string"},
+        "commits": {"type": "integer"},
+        "authors": {"type": "integer"},
+        "additions": {"type": "integer"},
+        "deletions": {"type": "integer"},
+        "first_commit": {"type": "string", "format": "date-time"},
+        "last_commit": {"type": "string", "format": "date-time"}
+      }},
+      "Commit": {"type": "object", "properties": {
+        "repo": {"type": "string"},
+        "hash": {"type": "string"},
+        "author_name": {"type": "string"},
+        "author_email": {"type": "string"},
+        "author_date": {"type": "string", "format": "date-time"},
+        "date": {"type": "string", "format": "date-time", "description": "Committer date"},
+        "title": {"type": "string"},
+        "additions": {"type": "integer"},
+        "deletions": {"type": "integer"},
+        "is_merge": {"type": "boolean"},
+        "type": {"type": "string"},
+        "scope": {"type": "string"},
+        "breaking": {"type": "boolean"},
+        "release": {"type": "string"}
+      }},
+      "Author": {"type": "object", "properties": {
+        "email": {"type": "string"},
+        "name": {"type": "string"},
+        "commits": {"type": "integer"},
+        "repos": {"type": "integer"},
+        "additions": {"type": "integer"},
+        "deletions": {"type": "integer"},
+        "first_commit": {"type": "string", "format": "date-time"},
+        "last_commit": {"type": "string", "format": "date-time"}
+      }},
+      "Activity": {"type": "object", "properties": {
+        "period": {"type": "string", "format": "date-time"},
+        "commits": {"type": "integer"},
+        "authors": {"type": "integer"},
+        "additions": {"type": "integer"},
+        "deletions": {"type": "integer"}
+      }},
+      "Language": {"type": "object", "properties": {
+        "language": {"type": "string"},
+        "commits": {"type": "integer"},
+        "files": {"type": "integer"},
+        "additions": {"type": "integer"},
+        "deletions": {"type": "integer"}
+      }},
+      "Type": {"type": "object", "properties": {
+        "type": {"type": "string"},
+        "commits": {"type": "integer"},
+        "breaking": {"type": "integer"},
+        "additions": {"type": "integer"},
+        "deletions": {"type": "integer"}
+      }},
+      "RepoPage": {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Repo"}}, "next_cursor": {"type": "string"}}},
+      "CommitPage": {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Commit"}}, "next_cursor": {"type": "string"}}},
+      "AuthorPage": {"type": "object", "properties": {"data": {"type": "array", "items": {"$ref": "#/components/schemas/Author"}}, "next_cursor": {"type": "string"}}}
+    }
+  }
+}`
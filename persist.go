@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Ingested data is written in bulk: rows are streamed with COPY into a
+// temporary copy of their table and merged into it with
+// INSERT ... ON CONFLICT DO NOTHING, so saving a range that is already
+// stored is a no-op rather than a stream of duplicate key errors.
+
+// rowSet is a batch of rows for the listed columns of a table. inserted is
+// set by copyUpsert to the number of rows that were not already stored.
+type rowSet struct {
+	table    string
+	columns  []string
+	rows     [][]interface{}
+	inserted int64
+}
+
+func (s *rowSet) add(values ...interface{}) {
+	s.rows = append(s.rows, values)
+}
+
+// copyUpsert merges a batch of rows into its table within tx
+func copyUpsert(tx *sql.Tx, s *rowSet) error {
+
+	if len(s.rows) == 0 {
+		return nil
+	}
+
+	stage := "stage_" + s.table
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", stage, s.table)); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn(stage, s.columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range s.rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	columns := strings.Join(s.columns, ", ")
+	res, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT DO NOTHING", s.table, columns, columns, stage))
+	if err != nil {
+		return err
+	}
+	if s.inserted, err = res.RowsAffected(); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP TABLE " + stage)
+	return err
+}
+
+// saveCommits stores the ingested commits and their files, parents,
+// trailers, work items and languages.
+func (r *Repo) saveCommits(tx *sql.Tx) error {
+
+	commits := &rowSet{table: "commits", columns: []string{"hash", "repo", "author", "date", "title", "body", "additions", "deletions", "is_merge",
+		"author_name", "author_email", "author_date", "author_tz", "committer_name", "committer_email", "committer_date", "committer_tz",
+		"cc_type", "cc_scope", "cc_breaking", "cc_conventional"}}
+	files := &rowSet{table: "commit_files", columns: []string{"hash", "repo", "path", "additions", "deletions", "binary", "old_path", "status", "similarity", "excluded"}}
+	parents := &rowSet{table: "commit_parents", columns: []string{"hash", "repo", "parent", "position"}}
+	trailers := &rowSet{table: "commit_trailers", columns: []string{"hash", "repo", "position", "key", "value"}}
+	workItems := &rowSet{table: "commit_work_items", columns: []string{"hash", "repo", "item"}}
+	langs := &rowSet{table: "commit_languages", columns: []string{"hash", "repo", "language", "files", "additions", "deletions"}}
+
+	for _, c := range r.Commits {
+		commits.add(c.Hash, c.Repo, c.Author, c.Date, c.Title, c.Body, c.Insertions, c.Deletions, c.IsMerge,
+			c.AuthorName, c.Author, c.AuthorDate, c.AuthorOffset, c.CommitterName, c.CommitterEmail, c.Date, c.CommitterOffset,
+			c.Class.Type, c.Class.Scope, c.Class.Breaking, c.Class.Conventional)
+		for _, f := range c.Files {
+			files.add(c.Hash, c.Repo, f.Path, f.Additions, f.Deletions, f.Binary, nullString(f.OldPath), f.Status, f.Similarity, c.Excluded[f.Path])
+		}
+		for i, p := range c.Parents {
+			parents.add(c.Hash, c.Repo, p, i)
+		}
+		for i, t := range c.Trailers {
+			trailers.add(c.Hash, c.Repo, i, t.Key, t.Value)
+		}
+		for _, w := range c.WorkItems {
+			workItems.add(c.Hash, c.Repo, w)
+		}
+		for _, l := range c.Languages {
+			langs.add(c.Hash, c.Repo, l.Language, l.Files, l.Additions, l.Deletions)
+		}
+	}
+
+	for _, s := range []*rowSet{commits, files, parents, trailers, workItems, langs} {
+		if err := copyUpsert(tx, s); err != nil {
+			return fmt.Errorf("error saving %s: %s", s.table, err.Error())
+		}
+	}
+	r.Ingested = int(commits.inserted)
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/mkessas/git-sentinel/gitlog"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresStore keeps ingested data in the schema described by migrations
+type postgresStore struct {
+	db *sql.DB
+}
+
+func openPostgres(dbURL string) (*postgresStore, error) {
+
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to database '%s': %s", dbURL, err.Error())
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to connect to database: %s", err.Error())
+	}
+	if err := checkSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &postgresStore{db: db}, nil
+}
+
+func (s *postgresStore) Load(r *Repo) error {
+
+	if err := r.resolveShortHashes(s.db); err != nil {
+		if _, ok := err.(*mirrorError); ok {
+			return err
+		}
+		return fmt.Errorf("Failed to resolve abbreviated hashes: %s", err.Error())
+	}
+
+	tags, err := r.loadTags(s.db)
+	if err != nil {
+		return fmt.Errorf("Failed to load tags: %s", err.Error())
+	}
+	r.knownTags = tags
+
+	refs, err := r.loadRefs(s.db)
+	if err != nil {
+		return fmt.Errorf("Failed to load ref watermarks: %s", err.Error())
+	}
+	r.Refs = refs
+	if len(r.Refs) > 0 {
+		return nil
+	}
+
+	// No watermarks yet: fall back to the latest commit date so databases
+	// populated before refs were tracked are not re-ingested in full
+	var date int64
+
+	err = s.db.QueryRow("SELECT date FROM commits WHERE repo = $1 ORDER BY date DESC LIMIT 1", r.Name).Scan(&date)
+	switch {
+	case err == sql.ErrNoRows:
+		r.LastUpdated = 0
+	case err != nil:
+		return fmt.Errorf("Failed to execute query: %s", err.Error())
+	default:
+		r.LastUpdated = date
+	}
+	return nil
+}
+
+// Save stores everything ingested for the repository, and moves its ref
+// watermarks forward, in a single transaction: either all of it is
+// committed or none of it is.
+func (s *postgresStore) Save(r *Repo) error {
+
+	r.Ingested = 0
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	steps := []struct {
+		name string
+		save func(*sql.Tx) error
+	}{{"commits", r.saveCommits}, {"branches", r.saveBranches}, {"tags", r.saveTags}, {"refs", r.saveRefs}}
+	for _, step := range steps {
+		err := saveStep(step.name)
+		if err == nil {
+			err = step.save(tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) Files(repo string) ([]*Commit, error) {
+
+	rows, err := s.db.Query(`SELECT hash, path, coalesce(old_path, ''), coalesce(status, ''), coalesce(similarity, 0), additions, deletions, binary
+		FROM commit_files WHERE repo = $1 ORDER BY hash, path`, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commits []*Commit
+	for rows.Next() {
+		var hash string
+		var f gitlog.File
+		if err := rows.Scan(&hash, &f.Path, &f.OldPath, &f.Status, &f.Similarity, &f.Additions, &f.Deletions, &f.Binary); err != nil {
+			return nil, err
+		}
+		if len(commits) == 0 || commits[len(commits)-1].Hash != hash {
+			commits = append(commits, &Commit{Repo: repo, Commit: gitlog.Commit{Hash: hash}})
+		}
+		c := commits[len(commits)-1]
+		c.Files = append(c.Files, f)
+	}
+	return commits, rows.Err()
+}
+
+// Restat rewrites the excluded flags, line counts and languages of the
+// commits in one transaction.
+func (s *postgresStore) Restat(repo string, commits []*Commit) error {
+
+	type statement struct {
+		query string
+		args  []interface{}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, c := range commits {
+		statements := []statement{
+			{"UPDATE commit_files SET excluded = FALSE WHERE repo = $1 AND hash = $2", []interface{}{repo, c.Hash}},
+			{"UPDATE commits SET additions = $3, deletions = $4 WHERE repo = $1 AND hash = $2", []interface{}{repo, c.Hash, c.Insertions, c.Deletions}},
+			{"DELETE FROM commit_languages WHERE repo = $1 AND hash = $2", []interface{}{repo, c.Hash}},
+		}
+		for p := range c.Excluded {
+			statements = append(statements, statement{"UPDATE commit_files SET excluded = TRUE WHERE repo = $1 AND hash = $2 AND path = $3", []interface{}{repo, c.Hash, p}})
+		}
+		for _, l := range c.Languages {
+			statements = append(statements, statement{"INSERT INTO commit_languages(hash, repo, language, files, additions, deletions) VALUES($2,$1,$3,$4,$5,$6)", []interface{}{repo, c.Hash, l.Language, l.Files, l.Additions, l.Deletions}})
+		}
+
+		for _, st := range statements {
+			if _, err := tx.Exec(st.query, st.args...); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) PathChanges(repo, path string, before int64) ([]PathChange, error) {
+
+	rows, err := s.db.Query(`SELECT c.hash, c.author, c.date, f.path, coalesce(f.old_path, ''), coalesce(f.status, ''), coalesce(f.similarity, 0), f.additions, f.deletions
+		FROM commit_files f JOIN commits c ON c.repo = f.repo AND c.hash = f.hash
+		WHERE f.repo = $1 AND f.path = $2 AND c.date <= $3
+		ORDER BY c.date DESC, c.hash`, repo, path, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []PathChange
+	for rows.Next() {
+		var p PathChange
+		if err := rows.Scan(&p.Hash, &p.Author, &p.Date, &p.Path, &p.OldPath, &p.Status, &p.Similarity, &p.Additions, &p.Deletions); err != nil {
+			return nil, err
+		}
+		changes = append(changes, p)
+	}
+	return changes, rows.Err()
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Ingestion is incremental on ref tips rather than dates: the tips recorded
+// after the last successful run are excluded from the walk, so every commit
+// reachable from a new tip but from none of the old ones is ingested exactly
+// once, whatever its author or committer date says.
+
+// defaultBranch returns the branch HEAD points to in the mirror
+func (r *Repo) defaultBranch() (string, error) {
+
+	cmd := exec.Command("git", "symbolic-ref", "--quiet", "HEAD")
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// refTips returns the commit each ref of the mirror points to, peeling
+// annotated tags. Refs that do not point to a commit are ignored. In
+// first-parent mode only the default branch is considered.
+func (r *Repo) refTips() (map[string]string, error) {
+
+	cmd := exec.Command("git", "for-each-ref", "--format=%(objecttype)\t%(objectname)\t%(*objecttype)\t%(*objectname)\t%(refname)")
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var only string
+	if r.FirstParent {
+		if only, err = r.defaultBranch(); err != nil {
+			return nil, fmt.Errorf("Failed to determine default branch: %s", err.Error())
+		}
+	}
+
+	tips := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 5 || (only != "" && f[4] != only) {
+			continue
+		}
+		switch {
+		case f[0] == "commit":
+			tips[f[4]] = f[1]
+		case f[0] == "tag" && f[2] == "commit":
+			tips[f[4]] = f[3]
+		}
+	}
+	return tips, nil
+}
+
+// revisions returns the revisions to feed to `git log --stdin`: every
+// current tip, and every previously ingested tip still present in the
+// mirror as an exclusion.
+func (r *Repo) revisions() ([]string, error) {
+
+	var old []string
+	for _, h := range r.Refs {
+		old = append(old, h)
+	}
+	present, err := r.presentObjects(old)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check previous ref tips: %s", err.Error())
+	}
+
+	seen := map[string]bool{}
+	var revs []string
+	for _, h := range r.Tips {
+		if !seen[h] {
+			seen[h] = true
+			revs = append(revs, h)
+		}
+	}
+	for _, h := range old {
+		if present[h] && !seen["^"+h] {
+			seen["^"+h] = true
+			revs = append(revs, "^"+h)
+		}
+	}
+	sort.Strings(revs)
+	return revs, nil
+}
+
+// presentObjects reports which of the given object names exist in the
+// mirror. Tips of force-pushed refs may have been garbage collected.
+func (r *Repo) presentObjects(hashes []string) (map[string]bool, error) {
+
+	present := map[string]bool{}
+	if len(hashes) == 0 {
+		return present, nil
+	}
+
+	cmd := exec.Command("git", "cat-file", "--batch-check=%(objectname)")
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	cmd.Stdin = strings.NewReader(strings.Join(hashes, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) == 1 {
+			present[f[0]] = true
+		}
+	}
+	return present, nil
+}
+
+// sameRefs reports whether two ref sets are identical
+func sameRefs(a, b map[string]string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for ref, h := range a {
+		if b[ref] != h {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repo) loadRefs(db *sql.DB) (map[string]string, error) {
+
+	refs := map[string]string{}
+	rows, err := db.Query("SELECT ref, hash FROM repo_refs WHERE repo = $1", r.Name)
+	if err != nil {
+		return refs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ref, hash string
+		if err := rows.Scan(&ref, &hash); err != nil {
+			return refs, err
+		}
+		refs[ref] = hash
+	}
+	return refs, rows.Err()
+}
+
+// saveRefs replaces the recorded ref tips of the repository with the ones
+// the current run ingested up to.
+func (r *Repo) saveRefs(tx *sql.Tx) error {
+
+	if r.Tips == nil {
+		return nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM repo_refs WHERE repo = $1", r.Name); err != nil {
+		return err
+	}
+	rows := &rowSet{table: "repo_refs", columns: []string{"repo", "ref", "hash"}}
+	for ref, hash := range r.Tips {
+		rows.add(r.Name, ref, hash)
+	}
+	return copyUpsert(tx, rows)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Renderers of the report: a self-contained HTML page, Markdown and CSV
+
+func (rp *report) filters() string {
+
+	var parts []string
+	if len(rp.RepoFilter) > 0 {
+		parts = append(parts, "repositories "+strings.Join(rp.RepoFilter, ", "))
+	}
+	if len(rp.AuthorFilter) > 0 {
+		parts = append(parts, "authors "+strings.Join(rp.AuthorFilter, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// cell renders a value with its trend, "12 (+20%)"
+func cell(cur, prev int64) string {
+	return fmt.Sprintf("%d (%s)", cur, change(cur, prev))
+}
+
+func (rp *report) markdown(w io.Writer) error {
+
+	bw := bufio.NewWriter(w)
+	day := func(t time.Time) string { return t.Format("2006-01-02") }
+
+	fmt.Fprintf(bw, "# Git Sentinel report\n\n")
+	fmt.Fprintf(bw, "%s to %s, compared with %s to %s.", day(rp.Since), day(rp.LastDay()), day(rp.PrevSince), day(rp.PrevLastDay()))
+	if f := rp.filters(); f != "" {
+		fmt.Fprintf(bw, " Only %s.", f)
+	}
+	fmt.Fprintf(bw, "\n\n## Summary\n\n")
+	fmt.Fprintf(bw, "| | Commits | Insertions | Deletions | Active authors | Active repositories |\n|---|---:|---:|---:|---:|---:|\n")
+	t := rp.Total
+	fmt.Fprintf(bw, "| This period | %d | %d | %d | %d | %d |\n", t.Cur.Commits, t.Cur.Insertions, t.Cur.Deletions, t.Cur.Authors(), t.Cur.Repos())
+	fmt.Fprintf(bw, "| Previous period | %d | %d | %d | %d | %d |\n", t.Prev.Commits, t.Prev.Insertions, t.Prev.Deletions, t.Prev.Authors(), t.Prev.Repos())
+	fmt.Fprintf(bw, "| Trend | %s | %s | %s | %s | %s |\n",
+		change(t.Cur.Commits, t.Prev.Commits), change(t.Cur.Insertions, t.Prev.Insertions), change(t.Cur.Deletions, t.Prev.Deletions),
+		change(t.Cur.Authors(), t.Prev.Authors()), change(t.Cur.Repos(), t.Prev.Repos()))
+
+	fmt.Fprintf(bw, "\n## Repositories\n\n| Repository | Commits | Insertions | Deletions | Active authors |\n|---|---:|---:|---:|---:|\n")
+	for _, r := range rp.Repos {
+		fmt.Fprintf(bw, "| %s | %s | %s | %s | %s |\n", markdownEscape(r.Name),
+			cell(r.Cur.Commits, r.Prev.Commits), cell(r.Cur.Insertions, r.Prev.Insertions), cell(r.Cur.Deletions, r.Prev.Deletions), cell(r.Cur.Authors(), r.Prev.Authors()))
+	}
+
+	fmt.Fprintf(bw, "\n## Authors\n\n| Author | Commits | Insertions | Deletions | Repositories |\n|---|---:|---:|---:|---:|\n")
+	for _, r := range rp.Authors {
+		name := r.Name
+		if r.Title != "" {
+			name = fmt.Sprintf("%s <%s>", r.Title, r.Name)
+		}
+		fmt.Fprintf(bw, "| %s | %s | %s | %s | %s |\n", markdownEscape(name),
+			cell(r.Cur.Commits, r.Prev.Commits), cell(r.Cur.Insertions, r.Prev.Insertions), cell(r.Cur.Deletions, r.Prev.Deletions), cell(r.Cur.Repos(), r.Prev.Repos()))
+	}
+
+	fmt.Fprintf(bw, "\n## Weeks\n\nTrends are compared with the week before.\n\n| Week of | Commits | Insertions | Deletions | Active authors |\n|---|---:|---:|---:|---:|\n")
+	for _, r := range rp.Weeks {
+		fmt.Fprintf(bw, "| %s | %s | %s | %s | %s |\n", r.Name,
+			cell(r.Cur.Commits, r.Prev.Commits), cell(r.Cur.Insertions, r.Prev.Insertions), cell(r.Cur.Deletions, r.Prev.Deletions), cell(r.Cur.Authors(), r.Prev.Authors()))
+	}
+	return bw.Flush()
+}
+
+func markdownEscape(s string) string {
+	return strings.NewReplacer(`|`, `\|`, `<`, `&lt;`, `>`, `&gt;`, "\n", " ").Replace(s)
+}
+
+// csv writes one row per summary, the section being total, repo, author or
+// week. The active column counts authors, or repositories for authors.
+func (rp *report) csv(w io.Writer) error {
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"section", "name", "title", "since", "until",
+		"commits", "insertions", "deletions", "active",
+		"prev_commits", "prev_insertions", "prev_deletions", "prev_active"})
+
+	since, until := rp.Since.Format("2006-01-02"), rp.LastDay().Format("2006-01-02")
+	write := func(section string, r *reportRow, since, until string, active func(stats) int64) {
+		i := func(v int64) string { return strconv.FormatInt(v, 10) }
+		cw.Write([]string{section, r.Name, r.Title, since, until,
+			i(r.Cur.Commits), i(r.Cur.Insertions), i(r.Cur.Deletions), i(active(r.Cur)),
+			i(r.Prev.Commits), i(r.Prev.Insertions), i(r.Prev.Deletions), i(active(r.Prev))})
+	}
+
+	total := rp.Total
+	total.Name = "total"
+	write("total", &total, since, until, stats.Authors)
+	for _, r := range rp.Repos {
+		write("repo", r, since, until, stats.Authors)
+	}
+	for _, r := range rp.Authors {
+		write("author", r, since, until, stats.Repos)
+	}
+	for _, r := range rp.Weeks {
+		start, _ := time.Parse("2006-01-02", r.Name)
+		write("week", r, r.Name, start.AddDate(0, 0, 6).Format("2006-01-02"), stats.Authors)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (rp *report) html(w io.Writer) error {
+
+	var max int64
+	for _, r := range rp.Weeks {
+		if r.Cur.Commits > max {
+			max = r.Cur.Commits
+		}
+	}
+	return reportTemplate.Execute(w, struct {
+		*report
+		Filters    string
+		MaxCommits int64
+	}{rp, rp.filters(), max})
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"day":    func(t time.Time) string { return t.Format("2006-01-02") },
+	"change": change,
+	// trend is the CSS class of a change
+	"trend": func(cur, prev int64) string {
+		switch {
+		case cur > prev:
+			return "up"
+		case cur < prev:
+			return "down"
+		}
+		return "same"
+	},
+	// values passes a value and its previous one to the value template
+	"values": func(v ...int64) []int64 { return v },
+	"bar": func(v, max int64) int64 {
+		if max == 0 {
+			return 0
+		}
+		return v * 100 / max
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Git Sentinel report {{day .Since}} to {{day .LastDay}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #24292f; margin: 2em auto; max-width: 70em; padding: 0 1em; }
+h1 { font-size: 1.6em; margin-bottom: 0.2em; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #d0d7de; padding-bottom: 0.3em; }
+p.period { color: #57606a; margin-top: 0; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { padding: 0.35em 0.6em; border-bottom: 1px solid #eaeef2; text-align: right; white-space: nowrap; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f6f8fa; }
+td.name { white-space: normal; }
+td.name small { color: #57606a; }
+.up { color: #1a7f37; }
+.down { color: #cf222e; }
+.same { color: #8c959f; }
+small.trend { margin-left: 0.3em; }
+.bar { display: inline-block; height: 0.8em; background: #54aeff; vertical-align: middle; }
+td.chart { width: 30%; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Git Sentinel report</h1>
+<p class="period">{{day .Since}} to {{day .LastDay}}, compared with {{day .PrevSince}} to {{day .PrevLastDay}}.{{if .Filters}} Only {{.Filters}}.{{end}} Generated {{.Generated.Format "2006-01-02 15:04 MST"}}.</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th></th><th>Commits</th><th>Insertions</th><th>Deletions</th><th>Active authors</th><th>Active repositories</th></tr>
+{{with .Total}}
+<tr><td>This period</td><td>{{.Cur.Commits}}</td><td>{{.Cur.Insertions}}</td><td>{{.Cur.Deletions}}</td><td>{{.Cur.Authors}}</td><td>{{.Cur.Repos}}</td></tr>
+<tr><td>Previous period</td><td>{{.Prev.Commits}}</td><td>{{.Prev.Insertions}}</td><td>{{.Prev.Deletions}}</td><td>{{.Prev.Authors}}</td><td>{{.Prev.Repos}}</td></tr>
+<tr><td>Trend</td>
+<td class="{{trend .Cur.Commits .Prev.Commits}}">{{change .Cur.Commits .Prev.Commits}}</td>
+<td class="{{trend .Cur.Insertions .Prev.Insertions}}">{{change .Cur.Insertions .Prev.Insertions}}</td>
+<td class="{{trend .Cur.Deletions .Prev.Deletions}}">{{change .Cur.Deletions .Prev.Deletions}}</td>
+<td class="{{trend .Cur.Authors .Prev.Authors}}">{{change .Cur.Authors .Prev.Authors}}</td>
+<td class="{{trend .Cur.Repos .Prev.Repos}}">{{change .Cur.Repos .Prev.Repos}}</td></tr>
+{{end}}
+</table>
+
+{{define "value"}}<td>{{index . 0}}<small class="trend {{trend (index . 0) (index . 1)}}">{{change (index . 0) (index . 1)}}</small></td>{{end}}
+
+<h2>Repositories</h2>
+<table>
+<tr><th>Repository</th><th>Commits</th><th>Insertions</th><th>Deletions</th><th>Active authors</th></tr>
+{{range .Repos}}<tr><td class="name">{{.Name}}</td>{{template "value" (values .Cur.Commits .Prev.Commits)}}{{template "value" (values .Cur.Insertions .Prev.Insertions)}}{{template "value" (values .Cur.Deletions .Prev.Deletions)}}{{template "value" (values .Cur.Authors .Prev.Authors)}}</tr>
+{{else}}<tr><td colspan="5">No commits</td></tr>
+{{end}}
+</table>
+
+<h2>Authors</h2>
+<table>
+<tr><th>Author</th><th>Commits</th><th>Insertions</th><th>Deletions</th><th>Repositories</th></tr>
+{{range .Authors}}<tr><td class="name">{{if .Title}}{{.Title}} <small>{{.Name}}</small>{{else}}{{.Name}}{{end}}</td>{{template "value" (values .Cur.Commits .Prev.Commits)}}{{template "value" (values .Cur.Insertions .Prev.Insertions)}}{{template "value" (values .Cur.Deletions .Prev.Deletions)}}{{template "value" (values .Cur.Repos .Prev.Repos)}}</tr>
+{{else}}<tr><td colspan="5">No commits</td></tr>
+{{end}}
+</table>
+
+<h2>Weeks</h2>
+<p class="period">Trends are compared with the week before.</p>
+<table>
+<tr><th>Week of</th><th></th><th>Commits</th><th>Insertions</th><th>Deletions</th><th>Active authors</th></tr>
+{{$max := .MaxCommits}}{{range .Weeks}}<tr><td>{{.Name}}</td><td class="chart"><span class="bar" style="width: {{bar .Cur.Commits $max}}%"></span></td>{{template "value" (values .Cur.Commits .Prev.Commits)}}{{template "value" (values .Cur.Insertions .Prev.Insertions)}}{{template "value" (values .Cur.Deletions .Prev.Deletions)}}{{template "value" (values .Cur.Authors .Prev.Authors)}}</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
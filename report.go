@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Reports summarise the commits of a period per repository, per author and
+// per week, and compare them with the period of the same length just
+// before it. Weeks start on Monday and are compared with the week before.
+// Dates are UTC.
+
+// stats are the totals of a set of commits
+type stats struct {
+	Commits    int64
+	Insertions int64
+	Deletions  int64
+	authors    map[string]bool
+	repos      map[string]bool
+}
+
+func (s *stats) add(c *reportCommit) {
+
+	if s.authors == nil {
+		s.authors, s.repos = map[string]bool{}, map[string]bool{}
+	}
+	s.Commits++
+	s.Insertions += c.insertions
+	s.Deletions += c.deletions
+	s.authors[c.email] = true
+	s.repos[c.repo] = true
+}
+
+// Authors is the number of active authors
+func (s stats) Authors() int64 {
+	return int64(len(s.authors))
+}
+
+// Repos is the number of active repositories
+func (s stats) Repos() int64 {
+	return int64(len(s.repos))
+}
+
+// reportRow compares the stats of a repository, author or week with the
+// previous period. Title is the name of an author.
+type reportRow struct {
+	Name  string
+	Title string
+	Cur   stats
+	Prev  stats
+}
+
+type report struct {
+	Since, Until, PrevSince time.Time
+	RepoFilter              []string
+	AuthorFilter            []string
+	Generated               time.Time
+	Total                   reportRow
+	Repos                   []*reportRow
+	Authors                 []*reportRow
+	Weeks                   []*reportRow
+}
+
+type reportCommit struct {
+	repo, email, name     string
+	date                  int64
+	insertions, deletions int64
+}
+
+var periodPattern = regexp.MustCompile(`^(\d+)([dw])$`)
+
+// parsePeriod parses a number of days ("30d") or weeks ("4w")
+func parsePeriod(s string) (int, error) {
+
+	m := periodPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid period '%s', expected a number of days or weeks such as 30d or 4w", s)
+	}
+	n, _ := strconv.Atoi(m[1])
+	if m[2] == "w" {
+		n *= 7
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("invalid period '%s'", s)
+	}
+	return n, nil
+}
+
+// splitList splits a comma separated flag value
+func splitList(s string) []string {
+
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// reportCommand writes a report of the stored commits:
+//
+//	git-sentinel report [-period 4w | -since YYYY-MM-DD] [-until YYYY-MM-DD]
+//	    [-repo a,b] [-author x@y,z@y] [-format html|md|csv] [-o file]
+func reportCommand(args []string) error {
+
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	period := fs.String("period", "4w", "length of the period, in days (30d) or weeks (4w)")
+	since := fs.String("since", "", "first day of the period (YYYY-MM-DD), instead of -period")
+	until := fs.String("until", "", "last day of the period (YYYY-MM-DD), today by default")
+	repoList := fs.String("repo", "", "comma separated repositories to report on, all by default")
+	authorList := fs.String("author", "", "comma separated author emails to report on, all by default")
+	format := fs.String("format", "html", "output format: html, md or csv")
+	output := fs.String("o", "", "file to write the report to, standard output by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: git-sentinel report [options], see git-sentinel report -h")
+	}
+
+	render := map[string]func(*report, io.Writer) error{"html": (*report).html, "md": (*report).markdown, "csv": (*report).csv}[*format]
+	if render == nil {
+		return fmt.Errorf("invalid format '%s', expected html, md or csv", *format)
+	}
+
+	now := time.Now().UTC()
+	rp := &report{Generated: now, Until: time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)}
+	if *until != "" {
+		t, err := time.Parse("2006-01-02", *until)
+		if err != nil {
+			return fmt.Errorf("invalid until date '%s', expected YYYY-MM-DD", *until)
+		}
+		rp.Until = t.AddDate(0, 0, 1)
+	}
+	if *since != "" {
+		t, err := time.Parse("2006-01-02", *since)
+		if err != nil {
+			return fmt.Errorf("invalid since date '%s', expected YYYY-MM-DD", *since)
+		}
+		rp.Since = t
+	} else {
+		days, err := parsePeriod(*period)
+		if err != nil {
+			return err
+		}
+		rp.Since = rp.Until.AddDate(0, 0, -days)
+	}
+	if !rp.Since.Before(rp.Until) {
+		return fmt.Errorf("the period starts after it ends")
+	}
+	rp.PrevSince = rp.Since.Add(-rp.Until.Sub(rp.Since))
+	rp.RepoFilter = splitList(*repoList)
+	for _, a := range splitList(*authorList) {
+		rp.AuthorFilter = append(rp.AuthorFilter, strings.ToLower(a))
+	}
+
+	if err := dbConnect(); err != nil {
+		return err
+	}
+	defer store.Close()
+	pg, ok := store.(*postgresStore)
+	if !ok {
+		return fmt.Errorf("Reports require a Postgres database")
+	}
+
+	// Weeks are compared with the week before, which may start before the
+	// previous period
+	from := weekStart(rp.Since).AddDate(0, 0, -7)
+	if rp.PrevSince.Before(from) {
+		from = rp.PrevSince
+	}
+	commits, err := loadReportCommits(pg.db, from, rp.Until, rp.RepoFilter, rp.AuthorFilter)
+	if err != nil {
+		return fmt.Errorf("Failed to query commits: %s", err.Error())
+	}
+	rp.build(commits)
+
+	if *output == "" {
+		return render(rp, os.Stdout)
+	}
+	// The temporary file must be on the same filesystem to be renamed
+	f, err := ioutil.TempFile(filepath.Dir(*output), "."+filepath.Base(*output))
+	if err != nil {
+		return err
+	}
+	if err := render(rp, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	os.Chmod(f.Name(), 0644)
+	if err := os.Rename(f.Name(), *output); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func loadReportCommits(db *sql.DB, from, until time.Time, repos, authors []string) ([]*reportCommit, error) {
+
+	f := &filter{}
+	f.add("c.date >= ?", from.Unix())
+	f.add("c.date < ?", until.Unix())
+	if len(repos) > 0 {
+		f.add("c.repo = ANY(?)", pq.Array(repos))
+	}
+	if len(authors) > 0 {
+		f.add("lower(c.author) = ANY(?)", pq.Array(authors))
+	}
+
+	rows, err := db.Query(`SELECT c.repo, coalesce(lower(c.author), ''), coalesce(c.author_name, ''), c.date, coalesce(c.additions, 0), coalesce(c.deletions, 0)
+		FROM commits c `+f.where()+` ORDER BY c.date`, f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commits []*reportCommit
+	for rows.Next() {
+		c := &reportCommit{}
+		if err := rows.Scan(&c.repo, &c.email, &c.name, &c.date, &c.insertions, &c.deletions); err != nil {
+			return nil, err
+		}
+		commits = append(commits, c)
+	}
+	return commits, rows.Err()
+}
+
+// weekStart returns the Monday of the week of t
+func weekStart(t time.Time) time.Time {
+
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// build computes the rows of the report from the commits of both periods
+// and the week before the first one.
+func (rp *report) build(commits []*reportCommit) {
+
+	since, prevSince := rp.Since.Unix(), rp.PrevSince.Unix()
+	repos := map[string]*reportRow{}
+	authors := map[string]*reportRow{}
+	weeks := map[int64]*stats{}
+
+	row := func(rows map[string]*reportRow, name string) *reportRow {
+		r, ok := rows[name]
+		if !ok {
+			r = &reportRow{Name: name}
+			rows[name] = r
+		}
+		return r
+	}
+
+	for _, c := range commits {
+		w := weekStart(time.Unix(c.date, 0)).Unix()
+		if weeks[w] == nil {
+			weeks[w] = &stats{}
+		}
+		weeks[w].add(c)
+
+		var pick func(*reportRow) *stats
+		switch {
+		case c.date >= since:
+			pick = func(r *reportRow) *stats { return &r.Cur }
+		case c.date >= prevSince:
+			pick = func(r *reportRow) *stats { return &r.Prev }
+		default:
+			continue
+		}
+		pick(&rp.Total).add(c)
+		pick(row(repos, c.repo)).add(c)
+		a := row(authors, c.email)
+		pick(a).add(c)
+		// Commits are in date order, so the latest name wins
+		if c.name != "" {
+			a.Title = c.name
+		}
+	}
+
+	rp.Repos, rp.Authors = sortedRows(repos), sortedRows(authors)
+
+	rp.Weeks = nil
+	for w := weekStart(rp.Since); w.Before(rp.Until); w = w.AddDate(0, 0, 7) {
+		r := &reportRow{Name: w.Format("2006-01-02")}
+		if s := weeks[w.Unix()]; s != nil {
+			r.Cur = *s
+		}
+		if s := weeks[w.AddDate(0, 0, -7).Unix()]; s != nil {
+			r.Prev = *s
+		}
+		rp.Weeks = append(rp.Weeks, r)
+	}
+}
+
+// sortedRows orders rows by commits in the period, then in the previous
+// one, then by name
+func sortedRows(rows map[string]*reportRow) []*reportRow {
+
+	list := make([]*reportRow, 0, len(rows))
+	for _, r := range rows {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Cur.Commits != b.Cur.Commits {
+			return a.Cur.Commits > b.Cur.Commits
+		}
+		if a.Prev.Commits != b.Prev.Commits {
+			return a.Prev.Commits > b.Prev.Commits
+		}
+		return a.Name < b.Name
+	})
+	return list
+}
+
+// change describes the trend of a value compared with the previous period
+func change(cur, prev int64) string {
+
+	switch {
+	case prev == 0 && cur == 0:
+		return "="
+	case prev == 0:
+		return "new"
+	}
+	return fmt.Sprintf("%+.0f%%", float64(cur-prev)*100/float64(prev))
+}
+
+// LastDay is the last day of the period, as Until is excluded
+func (rp *report) LastDay() time.Time {
+	return rp.Until.AddDate(0, 0, -1)
+}
+
+// PrevLastDay is the last day of the previous period
+func (rp *report) PrevLastDay() time.Time {
+	return rp.Since.AddDate(0, 0, -1)
+}
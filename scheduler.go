@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// In serve mode every repository is processed on its own schedule, an
+// interval ("30m") or a cron expression ("*/15 8-18 * * 1-5"), set with
+// schedule in sentinel.yaml. A repository whose refs did not move is polled
+// half as often after each such run, up to SENTINEL_MAX_INTERVAL, until
+// they move again. Every run is delayed by a random jitter of up to
+// SENTINEL_JITTER (and at most half the interval), so repositories sharing
+// a schedule do not all hit their server at once.
+//
+// Push webhooks bring the next run of a repository forward to
+// SENTINEL_WEBHOOK_DELAY from the first event, so a burst of pushes results
+// in a single run. A push received while the repository is running queues
+// another run once it is done.
+
+// defaultSchedule matches the hourly CronJob of the Helm chart
+const defaultSchedule = "1h"
+
+type schedule struct {
+	every time.Duration
+	cron  *cronSpec
+}
+
+func parseSchedule(s string) (schedule, error) {
+
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < time.Minute {
+			return schedule{}, fmt.Errorf("interval '%s' is shorter than a minute", s)
+		}
+		return schedule{every: d}, nil
+	}
+	c, err := parseCron(s)
+	if err != nil {
+		return schedule{}, fmt.Errorf("'%s' is neither an interval nor a cron expression: %s", s, err.Error())
+	}
+	if c.next(time.Now()).IsZero() {
+		return schedule{}, fmt.Errorf("cron expression '%s' never matches", s)
+	}
+	return schedule{cron: c}, nil
+}
+
+// compileSchedule parses the schedule of the repository, falling back to
+// the global one.
+func (r *Repo) compileSchedule(global string) error {
+
+	s := r.Schedule
+	if s == "" {
+		s = global
+	}
+	if s == "" {
+		s = defaultSchedule
+	}
+	sched, err := parseSchedule(s)
+	if err != nil {
+		return fmt.Errorf("[%s] invalid schedule: %s", r.Name, err.Error())
+	}
+	r.schedule = sched
+	return nil
+}
+
+// next returns when to run again after from, given the number of
+// consecutive runs that found nothing new.
+func (s schedule) next(from time.Time, idle int) time.Time {
+
+	if idle > 16 {
+		idle = 16
+	}
+
+	if s.cron == nil {
+		d := s.every
+		for i := 0; i < idle && d*2 <= opt.MaxInterval; i++ {
+			d *= 2
+		}
+		return from.Add(d)
+	}
+
+	// Dormant repositories skip occurrences of their cron expression
+	t := s.cron.next(from)
+	for i := 1; i < 1<<uint(idle); i++ {
+		n := s.cron.next(t)
+		if n.IsZero() || n.Sub(from) > opt.MaxInterval {
+			break
+		}
+		t = n
+	}
+	return t
+}
+
+// jitter returns a random delay spreading the runs of the schedule
+func (s schedule) jitter(rnd *rand.Rand) time.Duration {
+
+	max := opt.Jitter
+	if s.cron == nil && s.every/2 < max {
+		max = s.every / 2
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(max)))
+}
+
+// scheduled is a repository in serve mode. Runs get a copy of repo, so
+// nothing a run ingests outlives it.
+type scheduled struct {
+	repo    Repo
+	next    time.Time
+	idle    int
+	running bool
+	pushed  bool
+}
+
+// serveCommand keeps running, processing every repository on its schedule,
+// until interrupted:
+//
+//	git-sentinel serve
+func serveCommand(args []string) error {
+
+	if len(args) != 0 {
+		return fmt.Errorf("usage: git-sentinel serve")
+	}
+	if err := loadRepos(); err != nil {
+		return err
+	}
+	if err := prepDataDir(); err != nil {
+		return err
+	}
+	if err := dbConnect(); err != nil {
+		return err
+	}
+
+	loadMetricsFile()
+	triggers := make(chan string, 64)
+	mux := http.NewServeMux()
+	if opt.WebhookSecret != "" {
+		mux.Handle("/hooks/push", newWebhook(repos, opt.WebhookSecret, triggers))
+	} else {
+		log.Printf("SENTINEL_WEBHOOK_SECRET is not set, push webhooks are disabled")
+	}
+	mux.HandleFunc("/metrics", metricsHandler)
+	if handler, err := apiHandler(); err == nil {
+		mux.Handle("/api/", handler)
+	} else {
+		log.Printf("%s, not serving it", err.Error())
+	}
+	server, err := startServer(mux)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	serve(repos, triggers, stop)
+	stopServer(server)
+	return store.Close()
+}
+
+// serve runs the scheduler until a signal is received on stop, then waits
+// for the running repositories to finish. The names of pushed repositories
+// are received on triggers.
+func serve(list []Repo, triggers <-chan string, stop <-chan os.Signal) {
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// Every repository runs once on startup, spread over the jitter
+	entries := map[string]*scheduled{}
+	now := time.Now()
+	for _, r := range list {
+		entries[r.Name] = &scheduled{repo: r, next: now.Add(r.schedule.jitter(rnd))}
+	}
+
+	jobs := make(chan Repo, len(entries))
+	results := make(chan result, len(entries))
+	wg := startWorkers(jobs, results)
+	log.Printf("Scheduling %d repositories", len(entries))
+
+	for {
+		now := time.Now()
+		var wake time.Time
+		for _, e := range entries {
+			if e.running {
+				continue
+			}
+			if !e.next.After(now) {
+				e.running = true
+				jobs <- e.repo
+				continue
+			}
+			if wake.IsZero() || e.next.Before(wake) {
+				wake = e.next
+			}
+		}
+
+		var timer <-chan time.Time
+		if !wake.IsZero() {
+			timer = time.After(wake.Sub(now))
+		}
+
+		select {
+		case <-timer:
+		case res := <-results:
+			e := entries[res.name]
+			e.running = false
+			switch {
+			case res.err != nil:
+				log.Printf("[%s] %s", res.name, res.err.Error())
+			case res.moved:
+				e.idle = 0
+			default:
+				e.idle++
+			}
+			if e.pushed {
+				e.pushed = false
+				e.next = time.Now().Add(opt.WebhookDelay)
+			} else {
+				e.next = e.repo.schedule.next(time.Now(), e.idle).Add(e.repo.schedule.jitter(rnd))
+			}
+			log.Printf("[%s] Next run at %s", res.name, e.next.Format(time.RFC3339))
+			writeMetricsFile()
+		case name := <-triggers:
+			e := entries[name]
+			e.idle = 0
+			if e.running {
+				e.pushed = true
+				log.Printf("[%s] Push received while running, queued another run", name)
+			} else if due := time.Now().Add(opt.WebhookDelay); e.next.After(due) {
+				e.next = due
+				log.Printf("[%s] Push received, next run at %s", name, e.next.Format(time.RFC3339))
+			}
+		case sig := <-stop:
+			log.Printf("Received %s, waiting for running repositories to finish...", sig)
+			for drained := false; !drained; {
+				select {
+				case <-jobs:
+				default:
+					drained = true
+				}
+			}
+			close(jobs)
+			wg.Wait()
+			log.Printf("Stopped")
+			return
+		}
+	}
+}
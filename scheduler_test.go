@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+
+	tests := []struct {
+		spec  string
+		every time.Duration
+		cron  bool
+		err   bool
+	}{
+		{"30m", 30 * time.Minute, false, false},
+		{"1h30m", 90 * time.Minute, false, false},
+		{"1m", time.Minute, false, false},
+		{"30s", 0, false, true},
+		{"*/15 8-18 * * 1-5", 0, true, false},
+		{"@daily", 0, true, false},
+		{"0 0 30 2 *", 0, false, true},
+		{"soon", 0, false, true},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if (err != nil) != tt.err || s.every != tt.every || (s.cron != nil) != tt.cron {
+			t.Errorf("parseSchedule(%q) = %+v, %v", tt.spec, s, err)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+
+	defer func(max time.Duration) { opt.MaxInterval = max }(opt.MaxInterval)
+	from := time.Date(2024, 3, 1, 10, 7, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		max  time.Duration
+		idle int
+		want time.Time
+	}{
+		// Intervals double with every idle run, up to the cap
+		{"30m", 24 * time.Hour, 0, from.Add(30 * time.Minute)},
+		{"30m", 24 * time.Hour, 1, from.Add(time.Hour)},
+		{"30m", 24 * time.Hour, 3, from.Add(4 * time.Hour)},
+		{"30m", 24 * time.Hour, 5, from.Add(16 * time.Hour)},
+		{"30m", 24 * time.Hour, 6, from.Add(16 * time.Hour)},
+		{"30m", 24 * time.Hour, 1000, from.Add(16 * time.Hour)},
+		{"30m", 6 * time.Hour, 10, from.Add(4 * time.Hour)},
+		// The cap never shortens the configured interval
+		{"2h", time.Hour, 3, from.Add(2 * time.Hour)},
+		// Cron expressions skip occurrences, up to the cap
+		{"0 * * * *", 24 * time.Hour, 0, from.Add(53 * time.Minute)},
+		{"0 * * * *", 24 * time.Hour, 1, from.Add(time.Hour + 53*time.Minute)},
+		{"0 * * * *", 24 * time.Hour, 2, from.Add(3*time.Hour + 53*time.Minute)},
+		{"0 * * * *", 6 * time.Hour, 10, from.Add(5*time.Hour + 53*time.Minute)},
+		{"@daily", 24 * time.Hour, 1, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"@daily", 72 * time.Hour, 1, time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{"@daily", 72 * time.Hour, 5, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		opt.MaxInterval = tt.max
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.next(from, tt.idle); !got.Equal(tt.want) {
+			t.Errorf("%q idle %d, max %s: got %s, want %s", tt.spec, tt.idle, tt.max, got.Format(time.RFC3339), tt.want.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+
+	defer func(jitter time.Duration) { opt.Jitter = jitter }(opt.Jitter)
+	rnd := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		spec   string
+		jitter time.Duration
+		max    time.Duration
+	}{
+		{"1h", 5 * time.Minute, 5 * time.Minute},
+		{"4m", 5 * time.Minute, 2 * time.Minute},
+		{"*/5 * * * *", 5 * time.Minute, 5 * time.Minute},
+		{"1h", 0, 0},
+	}
+	for _, tt := range tests {
+		opt.Jitter = tt.jitter
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if j := s.jitter(rnd); j < 0 || (tt.max == 0 && j != 0) || (tt.max > 0 && j >= tt.max) {
+				t.Fatalf("%q with jitter %s: got %s, want less than %s", tt.spec, tt.jitter, j, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Databases created before full hashes were stored keyed commits on a
+// 12 character abbreviated hash alone. The functions below are used by the
+// full_hashes migration to convert such a schema in place to the
+// (repo, hash) identity; the abbreviated hashes themselves are resolved
+// against each mirror by resolveShortHashes.
+
+// hashWidth returns the declared width of the hash column of table, or 0 if
+// the table does not exist.
+func hashWidth(tx *sql.Tx, table string) (int, error) {
+
+	var width sql.NullInt64
+	err := tx.QueryRow("SELECT character_maximum_length FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'hash'", table).Scan(&width)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return int(width.Int64), err
+}
+
+func upgradeCommits(tx *sql.Tx) error {
+
+	width, err := hashWidth(tx, "commits")
+	if err != nil || width >= 40 {
+		return err
+	}
+
+	log.Printf("Upgrading table 'commits' to full hashes keyed on (repo, hash)...")
+	return execAll(tx,
+		"ALTER TABLE IF EXISTS commit_files DROP CONSTRAINT IF EXISTS commit_files_hash_fkey",
+		"ALTER TABLE commits DROP CONSTRAINT IF EXISTS commits_pkey",
+		"ALTER TABLE commits ALTER COLUMN hash TYPE VARCHAR(40)",
+		"ALTER TABLE commits ALTER COLUMN repo SET NOT NULL",
+		"ALTER TABLE commits ADD PRIMARY KEY (repo, hash)",
+	)
+}
+
+func upgradeCommitFiles(tx *sql.Tx) error {
+
+	width, err := hashWidth(tx, "commit_files")
+	if err != nil || width >= 40 {
+		return err
+	}
+
+	log.Printf("Upgrading table 'commit_files' to full hashes keyed on (repo, hash, path)...")
+	return execAll(tx,
+		"ALTER TABLE commit_files DROP CONSTRAINT IF EXISTS commit_files_pkey",
+		"ALTER TABLE commit_files ALTER COLUMN hash TYPE VARCHAR(40)",
+		"UPDATE commit_files f SET repo = c.repo FROM commits c WHERE f.repo IS NULL AND c.hash = f.hash",
+		"ALTER TABLE commit_files ALTER COLUMN repo SET NOT NULL",
+		"ALTER TABLE commit_files ADD PRIMARY KEY (repo, hash, path)",
+		"ALTER TABLE commit_files ADD FOREIGN KEY (repo, hash) REFERENCES commits(repo, hash) ON DELETE CASCADE ON UPDATE CASCADE",
+	)
+}
+
+// execAll runs statements in order within tx
+func execAll(tx *sql.Tx, statements ...string) error {
+
+	for _, s := range statements {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("%s: %s", s, err.Error())
+		}
+	}
+	return nil
+}
+
+// resolveShortHashes replaces abbreviated hashes stored for this repository
+// with the full object names found in the mirror. Hashes that are ambiguous
+// or missing from the mirror are left untouched and reported.
+func (r *Repo) resolveShortHashes(db *sql.DB) error {
+
+	rows, err := db.Query("SELECT hash FROM commits WHERE repo = $1 AND length(hash) < 40", r.Name)
+	if err != nil {
+		return err
+	}
+	var short []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			rows.Close()
+			return err
+		}
+		short = append(short, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(short) == 0 {
+		return nil
+	}
+
+	log.Printf("[%s] Resolving %d abbreviated hashes...", r.Name, len(short))
+
+	cmd := exec.Command("git", "cat-file", "--batch-check=%(objectname) %(objecttype)")
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	cmd.Stdin = strings.NewReader(strings.Join(short, "\n") + "\n")
+	out, err := cmd.Output()
+	observeGit(r.Name, "cat-file", err)
+	if err != nil {
+		return &mirrorError{fmt.Errorf("Failed to resolve abbreviated hashes: %s", gitError(err).Error())}
+	}
+
+	// cat-file answers one line per input line, in order
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	unresolved := 0
+	for i := 0; scanner.Scan() && i < len(short); i++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[1] != "commit" || len(fields[0]) != 40 {
+			log.Printf("[%s] Unable to resolve abbreviated hash %s: %s", r.Name, short[i], scanner.Text())
+			unresolved++
+			continue
+		}
+		if _, err := db.Exec("UPDATE commits SET hash = $1 WHERE repo = $2 AND hash = $3", fields[0], r.Name, short[i]); err != nil {
+			return err
+		}
+	}
+
+	if unresolved > 0 {
+		log.Printf("[%s] %d abbreviated hashes could not be resolved", r.Name, unresolved)
+	}
+	return nil
+}
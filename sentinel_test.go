@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestAssignDirs(t *testing.T) {
+
+	list := []Repo{
+		{Name: "a", URL: "https://dev.azure.com/org/projA/_git/api"},
+		{Name: "b", URL: "https://user@dev.azure.com/org/projB/_git/api"},
+		{Name: "c", URL: "https://github.com/me/tool.git"},
+		{Name: "d", URL: "git@github.com:me/site.git"},
+		{Name: "e", URL: "/srv/git/local/"},
+	}
+	if err := assignDirs(list); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dev.azure.com_org_proja__git_api.git", "dev.azure.com_org_projb__git_api.git", "tool.git", "site.git", "local.git"}
+	for i, r := range list {
+		if r.Dir != want[i] {
+			t.Errorf("%s: dir %q, want %q", r.URL, r.Dir, want[i])
+		}
+	}
+
+	dup := []Repo{
+		{Name: "a", URL: "https://github.com/me/tool.git"},
+		{Name: "b", URL: "https://token@github.com/me/tool"},
+	}
+	if err := assignDirs(dup); err == nil {
+		t.Errorf("assignDirs accepted the same URL twice")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startServer starts the HTTP server of serve mode on SENTINEL_LISTEN
+func startServer(handler http.Handler) (*http.Server, error) {
+
+	l, err := net.Listen("tcp", opt.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on '%s': %s", opt.Listen, err.Error())
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP server failed: %s", err.Error())
+		}
+	}()
+	log.Printf("Listening on '%s'", l.Addr())
+	return server, nil
+}
+
+// stopServer stops accepting requests and waits briefly for the ones in
+// progress
+func stopServer(server *http.Server) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Store is where ingested data is kept. The backend is chosen by the scheme
+// of SENTINEL_DB_URL: postgres:// (the default), mongodb:// or memory://.
+// Schema migrations and the reporting views are Postgres only.
+type Store interface {
+	// Load reads what the previous runs recorded for the repository: its
+	// ref watermarks, known tags and, without watermarks, the date of its
+	// latest commit. It is called once the mirror is up to date.
+	Load(r *Repo) error
+	// Save stores everything parse ingested for the repository and moves
+	// its ref watermarks forward. It sets Ingested to the number of commits
+	// that were not already stored.
+	Save(r *Repo) error
+	// Files returns the stored commits of a repository with their files,
+	// for reprocess.
+	Files(repo string) ([]*Commit, error)
+	// Restat replaces the excluded flags, line counts and language
+	// breakdown of stored commits.
+	Restat(repo string, commits []*Commit) error
+	// PathChanges returns the changes made to a path by commits dated up
+	// to before, newest first.
+	PathChanges(repo, path string, before int64) ([]PathChange, error)
+	Close() error
+}
+
+var store Store
+
+// mirrorError is a git command failing on the mirror during a store
+// operation, which is not a database error
+type mirrorError struct {
+	err error
+}
+
+func (e *mirrorError) Error() string {
+	return e.err.Error()
+}
+
+// saveFault lets tests make Save fail before one of its steps: commits,
+// branches, releases, tags or refs. It is nil otherwise.
+var saveFault func(step string) error
+
+// saveStep returns the error injected by saveFault before a step of Save
+func saveStep(step string) error {
+
+	if saveFault == nil {
+		return nil
+	}
+	return saveFault(step)
+}
+
+// openStore connects to the backend SENTINEL_DB_URL points to
+func openStore(dbURL string) (Store, error) {
+
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse database URL: %s", err.Error())
+	}
+
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		return openPostgres(dbURL)
+	case "mongodb":
+		return openMongo(dbURL)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("Unsupported database URL scheme '%s'", u.Scheme)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/mkessas/git-sentinel/gitlog"
+)
+
+// The same rules are checked against every store: the memory one always,
+// Postgres and MongoDB when SENTINEL_TEST_POSTGRES_URL or
+// SENTINEL_TEST_MONGO_URL point to a scratch database. Repositories are
+// named after the test run and removed afterwards.
+
+// inspector reads what the Store interface does not expose
+type inspector interface {
+	Store
+	branch(repo, ref string) ([]string, error)
+	release(repo, hash string) (string, error)
+	lines(repo, hash string) (int, int, []string, error)
+	drop(repo string) error
+}
+
+func (s *memoryStore) branch(repo, ref string) ([]string, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hashes []string
+	for h := range s.repo(repo).branches[ref] {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+func (s *memoryStore) release(repo, hash string) (string, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.repo(repo).releases[hash], nil
+}
+
+func (s *memoryStore) lines(repo, hash string) (int, int, []string, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.repo(repo).commits[hash]
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("no commit %s", hash)
+	}
+	var excluded []string
+	for p, ex := range c.Excluded {
+		if ex {
+			excluded = append(excluded, p)
+		}
+	}
+	sort.Strings(excluded)
+	return c.Insertions, c.Deletions, excluded, nil
+}
+
+func (s *memoryStore) drop(repo string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.repos, repo)
+	return nil
+}
+
+func (s *postgresStore) branch(repo, ref string) ([]string, error) {
+
+	rows, err := s.db.Query("SELECT hash FROM commit_branches WHERE repo = $1 AND ref = $2 ORDER BY hash", repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *postgresStore) release(repo, hash string) (string, error) {
+
+	var release string
+	err := s.db.QueryRow("SELECT coalesce(release, '') FROM commits WHERE repo = $1 AND hash = $2", repo, hash).Scan(&release)
+	return release, err
+}
+
+func (s *postgresStore) lines(repo, hash string) (int, int, []string, error) {
+
+	var insertions, deletions int
+	if err := s.db.QueryRow("SELECT additions, deletions FROM commits WHERE repo = $1 AND hash = $2", repo, hash).Scan(&insertions, &deletions); err != nil {
+		return 0, 0, nil, err
+	}
+	rows, err := s.db.Query("SELECT path FROM commit_files WHERE repo = $1 AND hash = $2 AND excluded ORDER BY path", repo, hash)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	excluded, err := scanStrings(rows)
+	return insertions, deletions, excluded, err
+}
+
+func (s *postgresStore) drop(repo string) error {
+
+	for _, table := range []string{"commit_branches", "repo_refs", "tags", "commits"} {
+		if _, err := s.db.Exec("DELETE FROM "+table+" WHERE repo = $1", repo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanStrings(rows *sql.Rows) ([]string, error) {
+
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (s *mongoStore) branch(repo, ref string) ([]string, error) {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+	var docs []struct {
+		Hash string `bson:"hash"`
+	}
+	if err := session.DB("").C("commit_branches").Find(bson.M{"repo": repo, "ref": ref}).Sort("hash").All(&docs); err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, d := range docs {
+		hashes = append(hashes, d.Hash)
+	}
+	return hashes, nil
+}
+
+func (s *mongoStore) commit(repo, hash string) (mongoCommit, error) {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+	var doc mongoCommit
+	err := session.DB("").C("commits").Find(bson.M{"repo": repo, "hash": hash}).One(&doc)
+	return doc, err
+}
+
+func (s *mongoStore) release(repo, hash string) (string, error) {
+
+	doc, err := s.commit(repo, hash)
+	return doc.Release, err
+}
+
+func (s *mongoStore) lines(repo, hash string) (int, int, []string, error) {
+
+	doc, err := s.commit(repo, hash)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var excluded []string
+	for _, f := range doc.Files {
+		if f.Excluded {
+			excluded = append(excluded, f.Path)
+		}
+	}
+	sort.Strings(excluded)
+	return doc.Additions, doc.Deletions, excluded, nil
+}
+
+func (s *mongoStore) drop(repo string) error {
+
+	session := s.m.Session.Copy()
+	defer session.Close()
+	for _, c := range []string{"commits", "commit_branches", "tags"} {
+		if _, err := session.DB("").C(c).RemoveAll(bson.M{"repo": repo}); err != nil {
+			return err
+		}
+	}
+	if err := session.DB("").C("repo_refs").RemoveId(repo); err != nil && err.Error() != "not found" {
+		return err
+	}
+	return nil
+}
+
+// testStores returns the stores to run the suite against
+func testStores(t *testing.T) map[string]inspector {
+
+	stores := map[string]inspector{"memory": newMemoryStore()}
+	if u := os.Getenv("SENTINEL_TEST_POSTGRES_URL"); u != "" {
+		auto := opt.AutoMigrate
+		opt.AutoMigrate = true
+		s, err := openPostgres(u)
+		opt.AutoMigrate = auto
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores["postgres"] = s
+	}
+	if u := os.Getenv("SENTINEL_TEST_MONGO_URL"); u != "" {
+		s, err := openMongo(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores["mongo"] = s
+	}
+	return stores
+}
+
+func testHash(n int) string {
+	return fmt.Sprintf("%040x", n)
+}
+
+func testCommit(repo string, n int, date int64, files ...gitlog.File) Commit {
+
+	c := Commit{Repo: repo, Commit: gitlog.Commit{Hash: testHash(n), Author: "jane@example.com", AuthorName: "Jane", Date: date, AuthorDate: date, Title: fmt.Sprintf("Commit %d", n)}}
+	for _, f := range files {
+		c.Insertions += f.Additions
+		c.Deletions += f.Deletions
+	}
+	c.Files = files
+	return c
+}
+
+func TestStores(t *testing.T) {
+
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := fmt.Sprintf("store-test-%d", time.Now().UnixNano())
+			defer func() {
+				if err := s.drop(repo); err != nil {
+					t.Errorf("Failed to clean up %s: %s", repo, err.Error())
+				}
+				s.Close()
+			}()
+			testStore(t, s, repo)
+		})
+	}
+}
+
+func testStore(t *testing.T, s inspector, name string) {
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() *Repo {
+		t.Helper()
+		r := &Repo{Name: name}
+		must(s.Load(r))
+		return r
+	}
+	expect := func(what string, got, want interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", what, got, want)
+		}
+	}
+	branch := func(ref string) []string {
+		t.Helper()
+		hashes, err := s.branch(name, ref)
+		must(err)
+		return hashes
+	}
+	release := func(n int) string {
+		t.Helper()
+		rel, err := s.release(name, testHash(n))
+		must(err)
+		return rel
+	}
+
+	// A repository never saved
+	r := load()
+	expect("refs", len(r.Refs), 0)
+	expect("tags", len(r.knownTags), 0)
+	expect("last updated", r.LastUpdated, int64(0))
+
+	// Without ref watermarks, Load falls back to the latest commit date
+	r = &Repo{Name: name, Commits: []Commit{testCommit(name, 1, 1000, gitlog.File{Path: "b.go", Status: "A", Additions: 10})}}
+	must(s.Save(r))
+	expect("ingested", r.Ingested, 1)
+	expect("last updated without refs", load().LastUpdated, int64(1000))
+
+	master := "refs/heads/master"
+	first := &Repo{
+		Name: name,
+		Commits: []Commit{
+			testCommit(name, 1, 1000, gitlog.File{Path: "b.go", Status: "A", Additions: 10}),
+			testCommit(name, 2, 2000,
+				gitlog.File{Path: "a.go", OldPath: "b.go", Status: "R", Similarity: 90, Additions: 2, Deletions: 1},
+				gitlog.File{Path: "vendor/x.go", Status: "A", Additions: 100}),
+			testCommit(name, 3, 3000, gitlog.File{Path: "a.go", Status: "M", Additions: 5, Deletions: 5}),
+		},
+		Branches: []Membership{{Ref: master, Commits: []string{testHash(1), testHash(2), testHash(3)}}},
+		Tags: []Tag{
+			{Name: "v1", Object: testHash(2), Target: testHash(2), Date: 2500, SignatureStatus: "unsigned", Release: true},
+			{Name: "nightly", Object: testHash(3), Target: testHash(3), Date: 3500, SignatureStatus: "unsigned"},
+		},
+		Releases: []Release{{Tag: "v1", Commits: []string{testHash(1), testHash(2)}}},
+		Tips:     map[string]string{master: testHash(3), "refs/tags/v1": testHash(2)},
+	}
+	must(s.Save(first))
+	expect("ingested with one already stored", first.Ingested, 2)
+
+	r = load()
+	expect("refs", r.Refs, first.Tips)
+	expect("known tags", r.knownTags, map[string]storedTag{"v1": {Object: testHash(2), Release: true}, "nightly": {Object: testHash(3)}})
+	expect("branch", branch(master), []string{testHash(1), testHash(2), testHash(3)})
+	expect("release of 1", release(1), "v1")
+	expect("release of 3", release(3), "")
+
+	// Saving the same run again changes nothing
+	must(s.Save(first))
+	expect("ingested after a re-save", first.Ingested, 0)
+	files, err := s.Files(name)
+	must(err)
+	expect("commits with files after a re-save", len(files), 3)
+	expect("branch after a re-save", branch(master), []string{testHash(1), testHash(2), testHash(3)})
+	expect("release after a re-save", release(2), "v1")
+
+	// Files returns every file of every commit, ordered by hash
+	expect("files of 2", files[1].Files, first.Commits[1].Files)
+
+	// A force push resets the membership of the branch
+	must(s.Save(&Repo{Name: name, Branches: []Membership{{Ref: master, Reset: true, Commits: []string{testHash(1), testHash(3)}}}, Tips: map[string]string{master: testHash(3)}}))
+	expect("branch after a reset", branch(master), []string{testHash(1), testHash(3)})
+	expect("refs after a reset", load().Refs, map[string]string{master: testHash(3)})
+
+	// Branch membership is only added to without a reset
+	must(s.Save(&Repo{Name: name, Branches: []Membership{{Ref: master, Commits: []string{testHash(2)}}}}))
+	expect("branch after an update", branch(master), []string{testHash(1), testHash(2), testHash(3)})
+
+	// An older release tagged after the fact takes over the commits it
+	// contains, a newer one does not
+	must(s.Save(&Repo{
+		Name:     name,
+		Tags:     []Tag{{Name: "v0", Object: testHash(1), Target: testHash(1), Date: 1500, SignatureStatus: "unsigned", Release: true}},
+		Releases: []Release{{Tag: "v0", Commits: []string{testHash(1)}}},
+	}))
+	expect("release of 1 after an older tag", release(1), "v0")
+	expect("release of 2 after an older tag", release(2), "v1")
+	must(s.Save(&Repo{
+		Name:     name,
+		Tags:     []Tag{{Name: "v2", Object: testHash(3), Target: testHash(3), Date: 4000, SignatureStatus: "unsigned", Release: true}},
+		Releases: []Release{{Tag: "v2", Commits: []string{testHash(2), testHash(3)}}},
+	}))
+	expect("release of 2 after a newer tag", release(2), "v1")
+	expect("release of 3 after a newer tag", release(3), "v2")
+
+	// A reset reassigns every commit from scratch, and deleted tags are
+	// forgotten
+	must(s.Save(&Repo{
+		Name:          name,
+		DeletedTags:   []string{"v0", "nightly"},
+		ResetReleases: true,
+		Releases:      []Release{{Tag: "v1", Commits: []string{testHash(1), testHash(2)}}, {Tag: "v2", Commits: []string{testHash(3)}}},
+	}))
+	expect("release of 1 after a reset", release(1), "v1")
+	expect("release of 3 after a reset", release(3), "v2")
+	expect("tags after deletions", load().knownTags, map[string]storedTag{"v1": {Object: testHash(2), Release: true}, "v2": {Object: testHash(3), Release: true}})
+
+	// Restat replaces line counts and exclusions
+	restat := files[1]
+	restat.Insertions, restat.Deletions = 2, 1
+	restat.Excluded = map[string]bool{"vendor/x.go": true}
+	restat.Languages = []LanguageStat{{Language: "Go", Files: 1, Additions: 2, Deletions: 1}}
+	must(s.Restat(name, []*Commit{restat}))
+	insertions, deletions, excluded, err := s.lines(name, testHash(2))
+	must(err)
+	expect("lines after restat", []int{insertions, deletions}, []int{2, 1})
+	expect("excluded after restat", excluded, []string{"vendor/x.go"})
+
+	// PathChanges lists the changes to a path up to a date, newest first
+	changes, err := s.PathChanges(name, "a.go", 5000)
+	must(err)
+	expect("changes", len(changes), 2)
+	if len(changes) == 2 {
+		expect("newest change", changes[0].Hash, testHash(3))
+		expect("rename", []string{changes[1].Hash, changes[1].OldPath, changes[1].Status}, []string{testHash(2), "b.go", "R"})
+		expect("rename similarity", changes[1].Similarity, 90)
+	}
+	changes, err = s.PathChanges(name, "a.go", 2500)
+	must(err)
+	expect("changes before 2500", len(changes), 1)
+	changes, err = s.PathChanges(name, strings.ToUpper("a.go"), 5000)
+	must(err)
+	expect("changes of another path", len(changes), 0)
+
+	// A run failing part way through never leaves a tag stored without its
+	// release assigned, as the retry would not assign it again
+	defer func() { saveFault = nil }()
+	next := &Repo{
+		Name:     name,
+		Commits:  []Commit{testCommit(name, 4, 6000)},
+		Branches: []Membership{{Ref: master, Commits: []string{testHash(4)}}},
+		Tags:     []Tag{{Name: "v3", Object: testHash(4), Target: testHash(4), Date: 6500, SignatureStatus: "unsigned", Release: true}},
+		Releases: []Release{{Tag: "v3", Commits: []string{testHash(4)}}},
+		Tips:     map[string]string{master: testHash(4)},
+	}
+	for _, step := range []string{"commits", "branches", "releases", "tags", "refs"} {
+		failed := step
+		saveFault = func(step string) error {
+			if step == failed {
+				return fmt.Errorf("failed before %s", step)
+			}
+			return nil
+		}
+		if err := s.Save(next); err == nil {
+			t.Errorf("Save did not fail before %s", step)
+		}
+		saveFault = nil
+		if _, ok := load().knownTags["v3"]; ok && release(4) != "v3" {
+			t.Errorf("tag stored without its release after failing before %s", step)
+		}
+	}
+	must(s.Save(next))
+	expect("release after a retry", release(4), "v3")
+	expect("refs after a retry", load().Refs, next.Tips)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Tag is a tag of the repository. Object is the tag object for annotated
+// tags and the tagged commit otherwise; Target is always the commit. Release
+// is set for tags matching the releases pattern of the repository.
+type Tag struct {
+	Name            string
+	Object          string
+	Target          string
+	Annotated       bool
+	TaggerName      string
+	TaggerEmail     string
+	Date            int64
+	Message         string
+	Signed          bool
+	SignatureStatus string
+	Release         bool
+}
+
+// Release lists the commits first contained in a release tag
+type Release struct {
+	Tag     string
+	Commits []string
+}
+
+// storedTag is what is known of a tag from a previous run
+type storedTag struct {
+	Object  string
+	Release bool
+}
+
+// compileReleases compiles the release tag pattern of the repository. Every
+// tag is a release when no pattern is configured.
+func (r *Repo) compileReleases() error {
+
+	r.releases = nil
+	if r.ReleasePattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.ReleasePattern)
+	if err != nil {
+		return fmt.Errorf("[%s] invalid releases pattern '%s': %s", r.Name, r.ReleasePattern, err.Error())
+	}
+	r.releases = re
+	return nil
+}
+
+func (r *Repo) isRelease(tag string) bool {
+	return r.releases == nil || r.releases.MatchString(tag)
+}
+
+// tags lists the tags of the mirror and works out the releases that need
+// their commits assigned. Commits are assigned to the earliest release
+// containing them, so a new release only claims what no earlier release
+// contains. When a release tag is deleted, moved or no longer matches the
+// releases pattern every assignment of the repository is recomputed.
+func (r *Repo) tags() error {
+
+	current, err := r.listTags()
+	if err != nil {
+		return err
+	}
+
+	r.Tags = nil
+	r.DeletedTags = nil
+	r.ResetReleases = false
+	r.Releases = nil
+
+	names := map[string]bool{}
+	var added []Tag
+	for _, t := range current {
+		names[t.Name] = true
+		old, known := r.knownTags[t.Name]
+		if known && old.Object == t.Object && old.Release == t.Release {
+			continue
+		}
+		if known && old.Release {
+			r.ResetReleases = true
+		}
+		if t.Annotated && t.Signed {
+			t.SignatureStatus = r.verifyTag(t.Name)
+		}
+		r.Tags = append(r.Tags, t)
+		added = append(added, t)
+	}
+	for name, old := range r.knownTags {
+		if !names[name] {
+			r.DeletedTags = append(r.DeletedTags, name)
+			r.ResetReleases = r.ResetReleases || old.Release
+		}
+	}
+
+	// Releases in chronological order, ties broken by name
+	var releases []Tag
+	for _, t := range current {
+		if t.Release {
+			releases = append(releases, t)
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		if releases[i].Date != releases[j].Date {
+			return releases[i].Date < releases[j].Date
+		}
+		return releases[i].Name < releases[j].Name
+	})
+
+	pending := map[string]bool{}
+	for _, t := range added {
+		pending[t.Name] = t.Release
+	}
+
+	for i, t := range releases {
+		if !r.ResetReleases && !pending[t.Name] {
+			continue
+		}
+		revs := []string{t.Target}
+		for _, earlier := range releases[:i] {
+			revs = append(revs, "^"+earlier.Target)
+		}
+		commits, err := r.revListStdin(revs)
+		if err != nil {
+			return err
+		}
+		r.Releases = append(r.Releases, Release{Tag: t.Name, Commits: commits})
+	}
+	return nil
+}
+
+// listTags reads every tag pointing to a commit, directly or through an
+// annotated tag object.
+func (r *Repo) listTags() ([]Tag, error) {
+
+	format := []string{
+		"%(refname:strip=2)", "%(objecttype)", "%(objectname)", "%(*objecttype)", "%(*objectname)",
+		"%(taggername)", "%(taggeremail)", "%(taggerdate:unix)", "%(committerdate:unix)",
+		"%(contents:subject)", "%(contents:body)", "%(contents:signature)",
+	}
+	cmd := exec.Command("git", "for-each-ref", "--format="+strings.Join(format, "%00")+"%1e", "refs/tags")
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tag messages are stored as text, like commit messages
+	var tags []Tag
+	for _, record := range strings.Split(strings.ToValidUTF8(string(out), "\uFFFD"), "\x1e") {
+		record = strings.TrimLeft(record, "\n")
+		if record == "" {
+			continue
+		}
+		f := strings.Split(record, "\x00")
+		if len(f) != len(format) {
+			return nil, fmt.Errorf("unexpected tag record %q", record)
+		}
+
+		t := Tag{Name: f[0], Object: f[2], Release: r.isRelease(f[0])}
+		switch {
+		case f[1] == "commit":
+			t.Target = f[2]
+			t.Date, _ = strconv.ParseInt(f[8], 10, 64)
+		case f[1] == "tag" && f[3] == "commit":
+			t.Target = f[4]
+			t.Annotated = true
+			t.TaggerName = f[5]
+			t.TaggerEmail = strings.Trim(f[6], "<>")
+			t.Date, _ = strconv.ParseInt(f[7], 10, 64)
+			t.Message = strings.TrimRight(f[9]+"\n\n"+f[10], "\n")
+			t.Signed = f[11] != ""
+		default:
+			continue
+		}
+		t.SignatureStatus = "unsigned"
+		if t.Signed {
+			t.SignatureStatus = "unverified"
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// verifyTag checks the signature of a tag against the keys available to git.
+// Signatures that cannot be checked, typically for lack of the public key,
+// are reported as unverified.
+func (r *Repo) verifyTag(name string) string {
+
+	cmd := exec.Command("git", "verify-tag", "--raw", name)
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	out, _ := cmd.CombinedOutput()
+	switch status := string(out); {
+	case strings.Contains(status, "[GNUPG:] BADSIG"):
+		return "bad"
+	case strings.Contains(status, "[GNUPG:] GOODSIG"), strings.Contains(status, "[GNUPG:] VALIDSIG"):
+		return "good"
+	}
+	return "unverified"
+}
+
+func (r *Repo) revListStdin(revs []string) ([]string, error) {
+
+	cmd := exec.Command("git", "rev-list", "--stdin")
+	cmd.Dir = path.Join(opt.DataDir, r.Dir)
+	cmd.Stdin = strings.NewReader(strings.Join(revs, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (r *Repo) loadTags(db *sql.DB) (map[string]storedTag, error) {
+
+	tags := map[string]storedTag{}
+	rows, err := db.Query("SELECT name, object, is_release FROM tags WHERE repo = $1", r.Name)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, object string
+		var release bool
+		if err := rows.Scan(&name, &object, &release); err != nil {
+			return tags, err
+		}
+		tags[name] = storedTag{Object: object, Release: release}
+	}
+	return tags, rows.Err()
+}
+
+// saveTags records new and changed tags, forgets deleted ones and assigns
+// commits to the releases that first contain them.
+func (r *Repo) saveTags(tx *sql.Tx) error {
+
+	for _, t := range r.Tags {
+		_, err := tx.Exec(`INSERT INTO tags(repo, name, object, target, annotated, tagger_name, tagger_email, date, message, signed, signature_status, is_release) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+			ON CONFLICT (repo, name) DO UPDATE SET object = EXCLUDED.object, target = EXCLUDED.target, annotated = EXCLUDED.annotated, tagger_name = EXCLUDED.tagger_name, tagger_email = EXCLUDED.tagger_email,
+			date = EXCLUDED.date, message = EXCLUDED.message, signed = EXCLUDED.signed, signature_status = EXCLUDED.signature_status, is_release = EXCLUDED.is_release`,
+			r.Name, t.Name, t.Object, t.Target, t.Annotated, nullString(t.TaggerName), nullString(t.TaggerEmail), t.Date, nullString(t.Message), t.Signed, t.SignatureStatus, t.Release)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(r.DeletedTags) > 0 {
+		if _, err := tx.Exec("DELETE FROM tags WHERE repo = $1 AND name = ANY($2)", r.Name, pq.Array(r.DeletedTags)); err != nil {
+			return err
+		}
+	}
+
+	if r.ResetReleases {
+		if _, err := tx.Exec("UPDATE commits SET release = NULL WHERE repo = $1 AND release IS NOT NULL", r.Name); err != nil {
+			return err
+		}
+	}
+
+	for _, rel := range r.Releases {
+		if len(rel.Commits) == 0 {
+			continue
+		}
+		// A release tagged after the fact on an older commit takes over
+		// the commits it contains from later releases
+		_, err := tx.Exec(`UPDATE commits c SET release = $1 WHERE c.repo = $2 AND c.hash = ANY($3)
+			AND (c.release IS NULL OR (SELECT t.date FROM tags t WHERE t.repo = c.repo AND t.name = c.release) > (SELECT t.date FROM tags t WHERE t.repo = c.repo AND t.name = $1))`,
+			rel.Tag, r.Name, pq.Array(rel.Commits))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// release_stats reports the cadence and size of every release
+const releaseStatsView = `CREATE OR REPLACE VIEW release_stats AS
+SELECT t.repo, t.name AS release, to_timestamp(t.date) AS date,
+	to_timestamp(lag(t.date) OVER w) AS previous_date,
+	(t.date - lag(t.date) OVER w) / 86400.0 AS days_since_previous,
+	coalesce(s.commits, 0) AS commits,
+	coalesce(s.authors, 0) AS authors,
+	coalesce(s.additions, 0) AS additions,
+	coalesce(s.deletions, 0) AS deletions
+FROM tags t
+LEFT JOIN (
+	SELECT repo, release, count(*) AS commits, count(DISTINCT lower(author)) AS authors,
+		sum(additions) AS additions, sum(deletions) AS deletions
+	FROM commits WHERE release IS NOT NULL GROUP BY repo, release
+) s ON s.repo = t.repo AND s.release = t.name
+WHERE t.is_release
+WINDOW w AS (PARTITION BY t.repo ORDER BY t.date, t.name)`
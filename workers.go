@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Repositories are processed by SENTINEL_WORKERS workers. Fetches and
+// clones are further limited to SENTINEL_HOST_CONCURRENCY at a time per git
+// host, so a pool sized for the CPU does not flood a single server.
+
+// result is the outcome of processing a repository. Moved is set when any
+// of its refs changed since the previous run.
+type result struct {
+	name    string
+	commits int
+	moved   bool
+	err     error
+}
+
+// startWorkers starts SENTINEL_WORKERS workers processing the repositories
+// sent on jobs until it is closed.
+func startWorkers(jobs <-chan Repo, results chan<- result) *sync.WaitGroup {
+
+	workers := opt.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each job is a copy, so whatever a run ingests is released
+			// as soon as it is saved
+			for r := range jobs {
+				err := r.process()
+				observeRun(r.Name, r.Ingested, err)
+				results <- result{name: r.Name, commits: len(r.Commits), moved: !sameRefs(r.Refs, r.Tips), err: err}
+			}
+		}()
+	}
+	return &wg
+}
+
+// processAll processes the repositories concurrently and returns the error
+// of each repository that failed, by name.
+func processAll(list []Repo) map[string]error {
+
+	jobs := make(chan Repo)
+	results := make(chan result)
+	wg := startWorkers(jobs, results)
+	go func() {
+		for _, r := range list {
+			jobs <- r
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	failures := map[string]error{}
+	for res := range results {
+		if res.err != nil {
+			log.Printf("[%s] %s", res.name, res.err.Error())
+			failures[res.name] = res.err
+		}
+	}
+	return failures
+}
+
+var hostSlots = struct {
+	sync.Mutex
+	slots map[string]chan struct{}
+}{slots: map[string]chan struct{}{}}
+
+// acquireHost waits for one of the network slots of the git host of the
+// repository and returns the function releasing it. Local repositories are
+// not limited.
+func (r *Repo) acquireHost() func() {
+
+	host := gitHost(r.URL)
+	if host == "" {
+		return func() {}
+	}
+
+	hostSlots.Lock()
+	slots, ok := hostSlots.slots[host]
+	if !ok {
+		n := opt.HostConcurrency
+		if n < 1 {
+			n = 1
+		}
+		slots = make(chan struct{}, n)
+		hostSlots.slots[host] = slots
+	}
+	hostSlots.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("[%s] Waiting for a connection to '%s'...", r.Name, host)
+		slots <- struct{}{}
+	}
+	return func() { <-slots }
+}
+
+// gitHost returns the host of a clone URL, including scp-like ones such as
+// git@github.com:me/repo.git, or "" for local paths.
+func gitHost(repoURL string) string {
+
+	if u, err := url.Parse(repoURL); err == nil && (u.Host != "" || u.Scheme == "file") {
+		return u.Hostname()
+	}
+	colon := strings.Index(repoURL, ":")
+	if colon > 0 && !strings.Contains(repoURL[:colon], "/") {
+		return repoURL[strings.Index(repoURL[:colon], "@")+1 : colon]
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// defaultWorkItems is used for repositories that do not define work_items:
+// Azure Boards mentions such as AB#1234.
+var defaultWorkItems = []string{`AB#\d+`}
+
+// maxWorkItem is the length of the longest work item kept. Patterns match
+// free text, and a longer match is not a reference anyone wrote on purpose.
+const maxWorkItem = 256
+
+// compileWorkItems compiles the work item patterns of the repository
+func (r *Repo) compileWorkItems() error {
+
+	patterns := r.WorkItems
+	if len(patterns) == 0 {
+		patterns = defaultWorkItems
+	}
+
+	r.workItems = nil
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("[%s] invalid work item pattern '%s': %s", r.Name, p, err.Error())
+		}
+		r.workItems = append(r.workItems, re)
+	}
+	return nil
+}
+
+// extractWorkItems returns the distinct work items referenced in text. A
+// pattern with a capturing group contributes the first group, otherwise the
+// whole match. Matches longer than maxWorkItem are ignored.
+func (r *Repo) extractWorkItems(text string) []string {
+
+	var items []string
+	seen := map[string]bool{}
+	for _, re := range r.workItems {
+		for _, m := range re.FindAllStringSubmatch(text, -1) {
+			item := m[0]
+			if len(m) > 1 && m[1] != "" {
+				item = m[1]
+			}
+			if len(item) <= maxWorkItem && !seen[item] {
+				seen[item] = true
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// work_item_rollup shows, for every work item, how many repositories,
+// authors, commits and lines it touched across all configured repositories.
+const workItemRollupView = `CREATE OR REPLACE VIEW work_item_rollup AS
+SELECT w.item,
+	count(DISTINCT w.repo) AS repos,
+	array_agg(DISTINCT w.repo) AS repo_names,
+	count(DISTINCT lower(c.author)) AS authors,
+	count(*) AS commits,
+	sum(c.additions) AS additions,
+	sum(c.deletions) AS deletions,
+	to_timestamp(min(c.date)) AS first_commit,
+	to_timestamp(max(c.date)) AS last_commit
+FROM commit_work_items w JOIN commits c ON c.repo = w.repo AND c.hash = w.hash
+GROUP BY w.item`